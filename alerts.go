@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Keeps track of the alerts that have gone off, whether anybody has
+// acknowledged them (i.e. ordered the gas) and who did it. Kept in
+// alerts.json so a restart doesn't forget an alert nobody has dealt
+// with yet (or re-send one that has).
+
+const alertsFile = "alerts.json"
+
+// How many resolved alerts to remember
+const alertHistoryLimit = 100
+
+type Alert struct {
+	Level   AlertLevel `json:"level"`
+	FiredAt time.Time  `json:"firedAt"`
+	// When we last posted about it, for re-notifying. Zero until it's
+	// been posted at all.
+	LastNotified time.Time `json:"lastNotified,omitzero"`
+	Escalated    bool      `json:"escalated,omitempty"`
+	// Who acknowledged it (Discord user ID and name) and when
+	AckedBy     string    `json:"ackedBy,omitempty"`
+	AckedByName string    `json:"ackedByName,omitempty"`
+	AckedAt     time.Time `json:"ackedAt,omitzero"`
+	ResolvedAt  time.Time `json:"resolvedAt,omitzero"`
+}
+
+func (a Alert) Acked() bool {
+	return a.AckedBy != ""
+}
+
+type AlertStore struct {
+	path string
+	data struct {
+		Active  map[AlertLevel]*Alert `json:"active"`
+		History []Alert               `json:"history"`
+	}
+	lock sync.RWMutex
+	// Everyone who wants to hear when the active alerts change
+	watchers map[chan []Alert]struct{}
+}
+
+// NewAlertStore loads the alert state kept at path
+func NewAlertStore(path string) *AlertStore {
+	s := &AlertStore{path: path, watchers: map[chan []Alert]struct{}{}}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to read alerts: %s\n", err)
+		}
+	} else if err := json.Unmarshal(data, &s.data); err != nil {
+		log.Printf("Failed to parse alerts: %s\n", err)
+	}
+	if s.data.Active == nil {
+		s.data.Active = map[AlertLevel]*Alert{}
+	}
+	return s
+}
+
+// Active returns the currently firing alert for the level, if any
+func (s *AlertStore) Active(level AlertLevel) (Alert, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	a, ok := s.data.Active[level]
+	if !ok {
+		return Alert{}, false
+	}
+	return *a, true
+}
+
+// ActiveAlerts returns every currently firing alert, in level order
+func (s *AlertStore) ActiveAlerts() []Alert {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.activeAlerts()
+}
+
+// Must be called with the lock held
+func (s *AlertStore) activeAlerts() []Alert {
+	var alerts []Alert
+	for _, l := range alertLevels {
+		if a, ok := s.data.Active[l]; ok {
+			alerts = append(alerts, *a)
+		}
+	}
+	return alerts
+}
+
+// Watch returns a channel that receives the active alerts whenever they
+// change (fired, acknowledged, resolved...), and a function to call when
+// you're done with it. Like Datastore.Watch, slow readers only get the
+// latest.
+func (s *AlertStore) Watch() (<-chan []Alert, func()) {
+	ch := make(chan []Alert, 1)
+	s.lock.Lock()
+	s.watchers[ch] = struct{}{}
+	s.lock.Unlock()
+
+	return ch, func() {
+		s.lock.Lock()
+		delete(s.watchers, ch)
+		s.lock.Unlock()
+	}
+}
+
+// History returns the resolved alerts, most recent last
+func (s *AlertStore) History() []Alert {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]Alert(nil), s.data.History...)
+}
+
+// Fire records a newly firing alert, whether or not anybody has been told
+// about it yet (see Notified)
+func (s *AlertStore) Fire(level AlertLevel, now time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Active[level] = &Alert{Level: level, FiredAt: now}
+	return s.save()
+}
+
+// Notified records that we posted about the alert, or reminded people
+// about it
+func (s *AlertStore) Notified(level AlertLevel, now time.Time, escalated bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	a, ok := s.data.Active[level]
+	if !ok {
+		return nil
+	}
+	a.LastNotified = now
+	a.Escalated = a.Escalated || escalated
+	return s.save()
+}
+
+// Ack marks the alert as dealt with by the given user. It returns false if
+// there's no such alert or somebody already acknowledged it.
+func (s *AlertStore) Ack(level AlertLevel, userID, userName string, now time.Time) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	a, ok := s.data.Active[level]
+	if !ok || a.Acked() {
+		return false, nil
+	}
+	a.AckedBy = userID
+	a.AckedByName = userName
+	a.AckedAt = now
+	return true, s.save()
+}
+
+// Resolve moves the alert into the history once its condition clears
+func (s *AlertStore) Resolve(level AlertLevel, now time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	a, ok := s.data.Active[level]
+	if !ok {
+		return nil
+	}
+	a.ResolvedAt = now
+	s.data.History = append(s.data.History, *a)
+	if len(s.data.History) > alertHistoryLimit {
+		s.data.History = s.data.History[len(s.data.History)-alertHistoryLimit:]
+	}
+	delete(s.data.Active, level)
+	return s.save()
+}
+
+// save writes the alerts out, then tells the watchers about them. If it
+// can't be written they don't hear about it, since it won't survive a
+// restart. Must be called with the lock held.
+func (s *AlertStore) save() error {
+	data, err := json.MarshalIndent(s.data, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path, data, 0644); err != nil {
+		return err
+	}
+
+	active := s.activeAlerts()
+	for ch := range s.watchers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- active
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestAlertStoreWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), alertsFile)
+	s := NewAlertStore(path)
+	updates, stop := s.Watch()
+	defer stop()
+
+	if err := s.Fire(AlertLow, monitorStart); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case active := <-updates:
+		if len(active) != 1 || active[0].Level != AlertLow {
+			t.Errorf("watchers got %+v, want the low alert", active)
+		}
+	default:
+		t.Fatalf("watchers should hear about the new alert")
+	}
+	if got := NewAlertStore(path).ActiveAlerts(); len(got) != 1 {
+		t.Errorf("the file has %+v, want the low alert", got)
+	}
+
+	// Watchers don't hear about anything that couldn't be saved
+	s.path = filepath.Join(t.TempDir(), "missing", alertsFile)
+	if err := s.Fire(AlertCritical, monitorStart); err == nil {
+		t.Fatalf("Fire() should fail when the alerts can't be saved")
+	}
+	select {
+	case active := <-updates:
+		levels := []AlertLevel{}
+		for _, a := range active {
+			levels = append(levels, a.Level)
+		}
+		if slices.Contains(levels, AlertCritical) {
+			t.Errorf("watchers heard about an alert that wasn't saved: %v", levels)
+		}
+	default:
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// A small MQTT broker that runs inside the bot, for installs where the
+// scale and the Pi are all there is and running Mosquitto as well would be
+// overkill. The scale publishes to it like it would any other broker, and
+// MQTTListener connects to it over loopback (see BrokerConfig.LocalURL),
+// so everything else works the same either way.
+
+type Broker struct {
+	BrokerConfig
+	lock sync.Mutex
+	// Set while it's up and running
+	server *mqtt.Server
+	addr   string
+}
+
+func (b *Broker) Run(ctx context.Context) func() error {
+	return func() error {
+		server := mqtt.New(&mqtt.Options{Logger: slog.Default()})
+
+		var err error
+		if b.Username != "" {
+			// Only let in whoever knows the login
+			err = server.AddHook(new(auth.Hook), &auth.Options{
+				Ledger: &auth.Ledger{Auth: auth.AuthRules{
+					{Username: auth.RString(b.Username), Password: auth.RString(b.Password), Allow: true},
+				}},
+			})
+		} else {
+			err = server.AddHook(new(auth.AllowHook), nil)
+		}
+		if err != nil {
+			return err
+		}
+		tcp := listeners.NewTCP(listeners.Config{ID: "tcp", Address: b.Address})
+		if err := server.AddListener(tcp); err != nil {
+			return fmt.Errorf("listening on %s: %w", b.Address, err)
+		}
+		if err := server.Serve(); err != nil {
+			return err
+		}
+		log.Printf("MQTT broker listening on %s\n", tcp.Address())
+		b.setServer(server, tcp.Address())
+
+		<-ctx.Done()
+		b.setServer(nil, "")
+		return server.Close()
+	}
+}
+
+func (b *Broker) setServer(server *mqtt.Server, addr string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.server, b.addr = server, addr
+}
+
+// Addr is where the broker is actually listening once it's running, which
+// is handy when Address is :0 (any free port). It's empty otherwise.
+func (b *Broker) Addr() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.addr
+}
+
+// Health is the health check for the broker: it has to be listening. How
+// many clients are connected (the scale, us...) is there too.
+func (b *Broker) Health() (bool, any) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var clients int64
+	if b.server != nil {
+		clients = atomic.LoadInt64(&b.server.Info.ClientsConnected)
+	}
+	serving := b.server != nil
+	return serving, struct {
+		Address string `json:"address"`
+		Serving bool   `json:"serving"`
+		Clients int64  `json:"clients"`
+	}{b.Address, serving, clients}
+}
+
+// LocalURL is where the bot itself connects to the broker
+func (cfg BrokerConfig) LocalURL() string {
+	host, port, err := net.SplitHostPort(cfg.Address)
+	if err != nil {
+		return ""
+	}
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return "tcp://" + net.JoinHostPort(host, port)
+}
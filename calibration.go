@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Scales drift, so readings get corrected before anything else sees them:
+//
+//	weight = raw*gain + offset
+//
+// The corrections come from putting known reference weights on the scale
+// (see /calibration on the web page) and comparing them with what the
+// scale says. Every calibration is kept in calibration.json, so we can see
+// how much the scale has drifted over time.
+
+const calibrationFile = "calibration.json"
+
+const (
+	// The reference weights have to be at least this far apart (in lbs)
+	// to tell the gain from noise. Closer than that, and only the offset
+	// is corrected.
+	minGainSpread = 5.0
+	// A gain outside this is more than the scale drifting, it's somebody
+	// typing in the wrong reference weight
+	minGain = 0.5
+	maxGain = 2.0
+)
+
+// CalibrationPoint is a reference weight and what the scale said it was
+type CalibrationPoint struct {
+	Reference float64   `json:"reference"`
+	Raw       float64   `json:"raw"`
+	At        time.Time `json:"at"`
+}
+
+type Calibration struct {
+	Offset float64 `json:"offset"`
+	Gain   float64 `json:"gain"`
+	// What the corrections were worked out from
+	Points []CalibrationPoint `json:"points"`
+	At     time.Time          `json:"at"`
+	By     string             `json:"by,omitempty"`
+}
+
+// Apply corrects a raw reading from the scale. The zero Calibration leaves
+// it alone.
+func (c Calibration) Apply(raw float64) float64 {
+	if c.Gain == 0 {
+		return raw
+	}
+	return raw*c.Gain + c.Offset
+}
+
+// Describe gives a one-line summary of the calibration for the web page
+func (c Calibration) Describe() string {
+	desc := "Calibrated " + FormatTime(c.At)
+	if c.By != "" {
+		desc += " by " + c.By
+	}
+	return desc + fmt.Sprintf(" with %d reference weight(s): gain %.4f, offset %+.2f lbs", len(c.Points), c.Gain, c.Offset)
+}
+
+// NewCalibration works out the corrections from the reference weights.
+// One reference weight can only say how far off the scale is (the offset).
+// With a few that are far enough apart, say an empty scale and a known
+// weight, it can also say whether the scale is further off the heavier
+// things get (the gain), using a least squares fit.
+func NewCalibration(points []CalibrationPoint, at time.Time, by string) (Calibration, error) {
+	if len(points) == 0 {
+		return Calibration{}, errors.New("there aren't any reference weights to work from")
+	}
+	var sumRaw, sumRef float64
+	minRaw, maxRaw := math.Inf(1), math.Inf(-1)
+	for _, p := range points {
+		if math.IsNaN(p.Reference) || math.IsInf(p.Reference, 0) || p.Reference < 0 || p.Reference > maxWeight {
+			return Calibration{}, fmt.Errorf("a reference weight of %v lbs doesn't make sense", p.Reference)
+		}
+		sumRaw += p.Raw
+		sumRef += p.Reference
+		minRaw, maxRaw = min(minRaw, p.Raw), max(maxRaw, p.Raw)
+	}
+	n := float64(len(points))
+	meanRaw, meanRef := sumRaw/n, sumRef/n
+
+	c := Calibration{Gain: 1, Points: slices.Clone(points), At: at, By: by}
+	if maxRaw-minRaw >= minGainSpread {
+		var sxy, sxx float64
+		for _, p := range points {
+			sxy += (p.Raw - meanRaw) * (p.Reference - meanRef)
+			sxx += (p.Raw - meanRaw) * (p.Raw - meanRaw)
+		}
+		c.Gain = sxy / sxx
+		if c.Gain < minGain || c.Gain > maxGain {
+			return Calibration{}, fmt.Errorf("that works out to the scale being off by a factor of %.2f, which is a lot more than drift. Are the reference weights right?", c.Gain)
+		}
+	}
+	c.Offset = meanRef - c.Gain*meanRaw
+	return c, nil
+}
+
+// CalibrationStore keeps the calibration history, and the reference
+// weights for the calibration somebody's in the middle of
+type CalibrationStore struct {
+	path    string
+	lock    sync.RWMutex
+	history []Calibration
+	pending []CalibrationPoint
+	// How many months a calibration is good for, 0 for forever
+	every int
+	// Called whenever there's a new calibration
+	onChange []func()
+}
+
+// NewCalibrationStore loads the calibrations kept at path
+func NewCalibrationStore(path string) *CalibrationStore {
+	s := &CalibrationStore{path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to read calibration: %s\n", err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(data, &s.history); err != nil {
+		log.Printf("Failed to parse calibration: %s\n", err)
+	}
+	return s
+}
+
+// SetReminder says how many months a calibration is good for before it's
+// due again, 0 for forever
+func (s *CalibrationStore) SetReminder(months int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.every = months
+}
+
+// Current returns the latest calibration, if the scale has ever been
+// calibrated
+func (s *CalibrationStore) Current() (Calibration, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if n := len(s.history); n > 0 {
+		return s.history[n-1], true
+	}
+	return Calibration{}, false
+}
+
+// Apply corrects a raw reading with the latest calibration
+func (s *CalibrationStore) Apply(raw float64) float64 {
+	c, _ := s.Current()
+	return c.Apply(raw)
+}
+
+// History returns every calibration, most recent first
+func (s *CalibrationStore) History() []Calibration {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	history := slices.Clone(s.history)
+	slices.Reverse(history)
+	return history
+}
+
+// Due says when the latest calibration runs out, and whether it already
+// has by now. A scale that's never been calibrated isn't due: the reminder
+// is on by default, and nagging every install that was happy with the raw
+// readings before calibration existed would just be noise. The
+// /calibration page still says it's never been done.
+func (s *CalibrationStore) Due(now time.Time) (time.Time, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	n := len(s.history)
+	if n == 0 || s.every <= 0 {
+		return time.Time{}, false
+	}
+	due := s.history[n-1].At.AddDate(0, s.every, 0)
+	return due, !now.Before(due)
+}
+
+// Pending returns the reference weights so far for the calibration in
+// progress
+func (s *CalibrationStore) Pending() []CalibrationPoint {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return slices.Clone(s.pending)
+}
+
+// AddPoint adds a reference weight to the calibration in progress. Each
+// one needs a new reading from the scale, so the same reading can't count
+// for two different weights.
+func (s *CalibrationStore) AddPoint(p CalibrationPoint) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if n := len(s.pending); n > 0 && !p.At.After(s.pending[n-1].At) {
+		return errors.New("there hasn't been a new reading from the scale since the last reference weight, give it a moment")
+	}
+	s.pending = append(s.pending, p)
+	return nil
+}
+
+// ClearPending starts the calibration in progress over
+func (s *CalibrationStore) ClearPending() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pending = nil
+}
+
+// Finish works out the corrections from the reference weights so far and
+// starts using them
+func (s *CalibrationStore) Finish(now time.Time, by string) (Calibration, error) {
+	s.lock.Lock()
+	c, err := NewCalibration(s.pending, now, by)
+	if err == nil {
+		s.history = append(s.history, c)
+		if err = s.save(); err != nil {
+			s.history = s.history[:len(s.history)-1]
+		}
+	}
+	if err != nil {
+		s.lock.Unlock()
+		return Calibration{}, err
+	}
+	s.pending = nil
+	onChange := s.onChange
+	s.lock.Unlock()
+
+	// Without the lock, since they'll probably want to Apply it
+	for _, f := range onChange {
+		f()
+	}
+	return c, nil
+}
+
+// OnChange adds a function to call whenever there's a new calibration
+func (s *CalibrationStore) OnChange(f func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.onChange = append(s.onChange, f)
+}
+
+// Must be called with the lock held
+func (s *CalibrationStore) save() error {
+	data, err := json.MarshalIndent(s.history, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0644)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var calibrationStart = time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// points makes calibration points a minute apart from reference, raw pairs
+func points(pairs ...float64) []CalibrationPoint {
+	var ps []CalibrationPoint
+	for i := 0; i+1 < len(pairs); i += 2 {
+		ps = append(ps, CalibrationPoint{Reference: pairs[i], Raw: pairs[i+1], At: calibrationStart.Add(time.Duration(i/2) * time.Minute)})
+	}
+	return ps
+}
+
+func TestNewCalibration(t *testing.T) {
+	tests := []struct {
+		name       string
+		points     []CalibrationPoint
+		gain       float64
+		offset     float64
+		wantErr    string
+		raw, wantW float64
+	}{
+		{"reads high", points(45, 46.5), 1, -1.5, "", 150, 148.5},
+		{"reads low when empty", points(0, -0.8), 1, 0.8, "", 100, 100.8},
+		{"offset and gain", points(0, 2, 50, 52.5), 50 / 50.5, -2 * 50 / 50.5, "", 52.5, 50},
+		{"least squares", points(0, 0, 25, 25.5, 50, 50.5), 0.990, -0.082, "", 0, -0.082},
+		// Too close together to tell the gain, so it's just the average offset
+		{"close together", points(20, 21, 22, 22.6), 1, -0.8, "", 100, 99.2},
+		{"nothing to go on", nil, 0, 0, "aren't any reference weights", 0, 0},
+		{"negative reference", points(-5, 1), 0, 0, "doesn't make sense", 0, 0},
+		{"wrong units", points(0, 0, 45, 20.4), 0, 0, "factor of 2.21", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewCalibration(tt.points, calibrationStart, "Sam")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewCalibration() error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewCalibration() error = %v", err)
+			}
+			if math.Abs(c.Gain-tt.gain) > 0.001 || math.Abs(c.Offset-tt.offset) > 0.01 {
+				t.Errorf("gain = %v, offset = %v, want %v and %v", c.Gain, c.Offset, tt.gain, tt.offset)
+			}
+			if got := c.Apply(tt.raw); math.Abs(got-tt.wantW) > 0.01 {
+				t.Errorf("Apply(%v) = %v, want %v", tt.raw, got, tt.wantW)
+			}
+		})
+	}
+}
+
+func TestCalibrationApplyUncalibrated(t *testing.T) {
+	if got := (Calibration{}).Apply(123.4); got != 123.4 {
+		t.Errorf("no calibration changed %v to %v", 123.4, got)
+	}
+}
+
+func TestCalibrationStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), calibrationFile)
+	s := NewCalibrationStore(path)
+	s.SetReminder(6)
+	if _, ok := s.Current(); ok {
+		t.Errorf("a new store shouldn't have a calibration")
+	}
+	if _, due := s.Due(calibrationStart.AddDate(1, 0, 0)); due {
+		t.Errorf("a scale that's never been calibrated isn't due")
+	}
+
+	ps := points(0, 1, 50, 51)
+	if err := s.AddPoint(ps[0]); err != nil {
+		t.Fatal(err)
+	}
+	// The same reading again doesn't count
+	if err := s.AddPoint(CalibrationPoint{Reference: 50, Raw: 1, At: ps[0].At}); err == nil {
+		t.Errorf("AddPoint() should want a new reading for each reference weight")
+	}
+	if err := s.AddPoint(ps[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := s.Finish(calibrationStart, "Sam")
+	if err != nil {
+		t.Fatalf("Finish() error = %v", err)
+	}
+	if got := s.Apply(51); math.Abs(got-50) > 0.001 {
+		t.Errorf("Apply(51) = %v, want 50", got)
+	}
+	if got := s.Pending(); len(got) != 0 {
+		t.Errorf("the reference weights should have been cleared, got %+v", got)
+	}
+	if _, err := s.Finish(calibrationStart, "Sam"); err == nil {
+		t.Errorf("Finish() with no reference weights should fail")
+	}
+
+	// A second one, and they're both kept (in the file too), newest first
+	if err := s.AddPoint(CalibrationPoint{Reference: 0, Raw: 2, At: calibrationStart.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	later := calibrationStart.AddDate(0, 1, 0)
+	if _, err := s.Finish(later, "Alex"); err != nil {
+		t.Fatal(err)
+	}
+	history := NewCalibrationStore(path).History()
+	if len(history) != 2 || history[0].By != "Alex" || !history[1].At.Equal(c.At) {
+		t.Fatalf("history = %+v, want Alex's then Sam's", history)
+	}
+
+	// Due six months after the latest one
+	wantDue := later.AddDate(0, 6, 0)
+	if dueAt, due := s.Due(wantDue.Add(-time.Minute)); due || !dueAt.Equal(wantDue) {
+		t.Errorf("Due() = %s, %v, want %s and not yet", dueAt, due, wantDue)
+	}
+	if _, due := s.Due(wantDue); !due {
+		t.Errorf("it should be due by %s", wantDue)
+	}
+	s.SetReminder(0)
+	if _, due := s.Due(wantDue.AddDate(5, 0, 0)); due {
+		t.Errorf("with no reminder it's never due")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// What time it is as far as the alerts, forecasts and readings are
+// concerned. That's the real time (in UTC), except in simulate mode where
+// it can run a lot faster.
+
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now().UTC()
+}
+
+var (
+	clock   Clock = realClock{}
+	clockMu sync.RWMutex
+)
+
+// Now is the current time according to the bot's clock
+func Now() time.Time {
+	clockMu.RLock()
+	defer clockMu.RUnlock()
+	return clock.Now()
+}
+
+// SetClock swaps out the bot's clock
+func SetClock(c Clock) {
+	clockMu.Lock()
+	defer clockMu.Unlock()
+	clock = c
+}
+
+// nowFrom is the time according to c, or the bot's clock if c is nil.
+// Anything that keeps its own Clock uses it, so tests don't have to change
+// everyone else's.
+func nowFrom(c Clock) time.Time {
+	if c == nil {
+		return Now()
+	}
+	return c.Now()
+}
+
+// SimClock runs speed times faster than real time, starting from start
+type SimClock struct {
+	start     time.Time
+	wallStart time.Time
+	speed     float64
+}
+
+func NewSimClock(start time.Time, speed float64) *SimClock {
+	return &SimClock{start: start.UTC(), wallStart: time.Now(), speed: speed}
+}
+
+func (c *SimClock) Now() time.Time {
+	return c.start.Add(time.Duration(float64(time.Since(c.wallStart)) * c.speed))
+}
+
+// Real is how long d of simulated time takes in real time
+func (c *SimClock) Real(d time.Duration) time.Duration {
+	return time.Duration(float64(d) / c.speed)
+}
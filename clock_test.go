@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// fixedClock is always the same time, for handing to anything that keeps
+// its own Clock
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestSimClock(t *testing.T) {
+	c := NewSimClock(monitorStart, 3600)
+	time.Sleep(10 * time.Millisecond)
+	// 10ms is 36s at an hour a second
+	if got := c.Now().Sub(monitorStart); got < 36*time.Second || got > time.Hour {
+		t.Errorf("%s of simulated time went by, want a little more than 36s", got)
+	}
+	if got := c.Real(time.Hour); got != time.Second {
+		t.Errorf("Real(1h) = %s, want 1s", got)
+	}
+}
+
+func TestDatastoreClock(t *testing.T) {
+	ds := NewDatastore(newTestCylinderStore(t))
+	ds.SetClock(fixedClock(monitorStart.Add(3 * time.Minute)))
+	ds.Set(110, monitorStart)
+	if got := ds.GetString(); !strings.Contains(got, "(3 minutes ago)") {
+		t.Errorf("GetString() = %q, want the reading 3 minutes ago", got)
+	}
+}
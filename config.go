@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configuration is layered: the defaults below, then config.json (or
+// whatever -config points at), then environment variables. Every
+// setting can be overridden with PROPANEBOT_<SECTION>_<SETTING>, e.g.
+// PROPANEBOT_DISCORD_BOTTOKEN, and each of those has a _FILE variant
+// (PROPANEBOT_DISCORD_BOTTOKEN_FILE=/run/secrets/bot_token) that reads
+// the value from a file, Docker secrets style.
+
+const envPrefix = "PROPANEBOT"
+
+// Each section with an "enabled" setting can be turned off on its own,
+// e.g. to run without Discord while testing.
+type AppConfig struct {
+	MQTT    MQTTConfig    `json:"mqtt"`
+	Broker  BrokerConfig  `json:"broker"`
+	Serial  SerialConfig  `json:"serial"`
+	Discord DiscordConfig `json:"discord"`
+	// Announces the tank to Home Assistant over MQTT
+	HomeAssistant HomeAssistantConfig `json:"homeAssistant"`
+	Web           struct {
+		Enabled bool `json:"enabled"`
+		Port    int  `json:"port"`
+		// Scales that can't do MQTT can POST readings to /api/readings
+		// with this as a bearer token. Leave empty to turn that off.
+		IngestToken string `json:"ingestToken"`
+	} `json:"web"`
+	Monitor struct {
+		Enabled bool `json:"enabled"`
+		// How often the monitor checks the propane level
+		Interval Duration `json:"interval"`
+	} `json:"monitor"`
+	Alerts  AlertConfig   `json:"alerts"`
+	Display DisplayConfig `json:"display"`
+}
+
+type MQTTConfig struct {
+	Enabled bool   `json:"enabled"`
+	Server  string `json:"server"`
+	Topic   string `json:"topic"`
+	// Where to publish the percent remaining, forecast and alerts for
+	// other things to use (e.g. propane/state). Leave empty to not publish.
+	PublishTopic string `json:"publishTopic"`
+	// Optional, for brokers that need a login
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Has to be unique on the broker. Defaults to one made from the
+	// hostname and working directory, so two bots on the same host don't
+	// kick each other off.
+	ClientID string `json:"clientId"`
+	// 1 (the default) makes sure each reading gets to us at least once
+	QoS int `json:"qos"`
+	// Leave this off so the broker holds on to readings published while
+	// we're restarting and hands them over when we're back
+	CleanSession bool `json:"cleanSession"`
+	// For ssl:// and wss:// brokers: a PEM CA to trust on top of the
+	// system ones, and a client certificate and key if the broker wants one
+	CACert             string `json:"caCert"`
+	ClientCert         string `json:"clientCert"`
+	ClientKey          string `json:"clientKey"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+}
+
+// An MQTT broker inside the bot, for when there's nothing else that needs
+// one. Unless mqtt.server says otherwise, the bot uses it too.
+type BrokerConfig struct {
+	Enabled bool `json:"enabled"`
+	// Where to listen, like :1883
+	Address string `json:"address"`
+	// Optional login the scale has to use
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// For a scale plugged straight into the Pi
+type SerialConfig struct {
+	Enabled bool `json:"enabled"`
+	// Like /dev/ttyUSB0, or any character device or pipe
+	Device string `json:"device"`
+	// Set this for a real serial port, leave it 0 for anything else
+	BaudRate int `json:"baudRate"`
+	// Pulls the weight (in lbs) out of each line, from a group named
+	// weight or else the first group. A group named timestamp (unix
+	// seconds) is used too if there is one, otherwise it's now.
+	LineRegex string `json:"lineRegex"`
+	// Only pass along one reading this often
+	Interval Duration `json:"interval"`
+}
+
+type DiscordConfig struct {
+	Enabled   bool   `json:"enabled"`
+	AppToken  string `json:"appToken"`
+	GuildID   string `json:"guildId"`
+	BotToken  string `json:"botToken"`
+	ChannelID string `json:"channelId"`
+	UserID    string `json:"userId"`
+}
+
+// How times are shown in Discord and on the web page. They're
+// stored in UTC no matter what.
+type DisplayConfig struct {
+	// An IANA timezone name like America/Chicago
+	Timezone string `json:"timezone"`
+	// A Go time layout, see https://pkg.go.dev/time#pkg-constants
+	TimeFormat string `json:"timeFormat"`
+}
+
+type HomeAssistantConfig struct {
+	Enabled         bool   `json:"enabled"`
+	DiscoveryPrefix string `json:"discoveryPrefix"`
+	// Identifies the tank in Home Assistant, only needs changing if
+	// there's more than one
+	NodeID string `json:"nodeId"`
+}
+
+// Settings for when alerts go off and chasing up the ones nobody has
+// acknowledged
+type AlertConfig struct {
+	// Percentages below which the low and critical alerts go off
+	LowThreshold      float64 `json:"lowThreshold"`
+	CriticalThreshold float64 `json:"criticalThreshold"`
+	// How often to repeat an unacknowledged alert
+	RenotifyEvery Duration `json:"renotifyEvery"`
+	// How long an alert can go unacknowledged before we pull in the
+	// escalation user and/or role
+	EscalateAfter    Duration `json:"escalateAfter"`
+	EscalationUserID string   `json:"escalationUserId"`
+	EscalationRoleID string   `json:"escalationRoleId"`
+	// How long the supplier takes to deliver, plus how much slack we
+	// want on top. When the forecast says we'll run out sooner than that,
+	// it's time to order.
+	SupplierLeadTime Duration `json:"supplierLeadTime"`
+	SafetyMargin     Duration `json:"safetyMargin"`
+	// How long the MQTT broker can be unreachable before we complain
+	BrokerDownAfter Duration `json:"brokerDownAfter"`
+	// How many months the scale can go between calibrations before we
+	// remind somebody, 0 for never
+	CalibrationMonths int `json:"calibrationMonths"`
+}
+
+// Duration lets config.json hold durations like "12h" or "90m"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.parse(s)
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) parse(s string) error {
+	if s == "" {
+		d.Duration = 0
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// DefaultConfig returns the settings used for anything config.json and the
+// environment leave out
+func DefaultConfig() AppConfig {
+	var cfg AppConfig
+	cfg.MQTT.Enabled = true
+	cfg.MQTT.QoS = 1
+	cfg.Broker.Address = ":1883"
+	cfg.Serial.LineRegex = defaultLineRegex
+	cfg.Serial.Interval = Duration{5 * time.Second}
+	cfg.Discord.Enabled = true
+	cfg.HomeAssistant.DiscoveryPrefix = "homeassistant"
+	cfg.HomeAssistant.NodeID = "propanebot"
+	cfg.Web.Enabled = true
+	cfg.Web.Port = 9991
+	cfg.Monitor.Enabled = true
+	cfg.Monitor.Interval = Duration{10 * time.Second}
+	cfg.Alerts.LowThreshold = 20.0
+	cfg.Alerts.CriticalThreshold = 10.0
+	cfg.Alerts.RenotifyEvery = Duration{12 * time.Hour}
+	cfg.Alerts.EscalateAfter = Duration{48 * time.Hour}
+	cfg.Alerts.BrokerDownAfter = Duration{15 * time.Minute}
+	cfg.Alerts.CalibrationMonths = 6
+	cfg.Display.Timezone = defaultTimezone
+	cfg.Display.TimeFormat = defaultTimeFormat
+	return cfg
+}
+
+// LoadConfig reads the config file at path into cfg. Settings in the
+// file we don't know about are reported as errors, including ones that
+// are only capitalized differently (encoding/json would quietly accept
+// those, but then so would a typo we'd want to hear about).
+func LoadConfig(path string, cfg *AppConfig) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	var errs []error
+	for _, err := range checkKeys(raw, reflect.TypeFor[AppConfig](), "") {
+		errs = append(errs, fmt.Errorf("%s: %w", path, err))
+	}
+	return errors.Join(errs...)
+}
+
+// checkKeys compares the keys in the config file against the json tags of
+// the struct they're meant to fill in
+func checkKeys(raw map[string]any, t reflect.Type, prefix string) []error {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if tag != "" && tag != "-" {
+			fields[tag] = t.Field(i).Type
+		}
+	}
+
+	var errs []error
+	for key, value := range raw {
+		ft, ok := fields[key]
+		if !ok {
+			suggestion := ""
+			for tag := range fields {
+				if strings.EqualFold(tag, key) {
+					suggestion = fmt.Sprintf(" (did you mean %q?)", prefix+tag)
+				}
+			}
+			errs = append(errs, fmt.Errorf("unknown setting %q%s", prefix+key, suggestion))
+			continue
+		}
+		if nested, ok := value.(map[string]any); ok && ft.Kind() == reflect.Struct && ft != reflect.TypeFor[Duration]() {
+			errs = append(errs, checkKeys(nested, ft, prefix+key+".")...)
+		}
+	}
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errs
+}
+
+// Validate checks the settings make sense, reporting every problem it
+// finds rather than just the first
+func (cfg AppConfig) Validate() error {
+	var errs []error
+	problem := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if cfg.MQTT.Enabled {
+		if cfg.MQTT.Server == "" {
+			problem("mqtt.server is required (something like tcp://mqtt.local:1883), unless the built-in broker is turned on")
+		} else if u, err := url.Parse(cfg.MQTT.Server); err != nil || !slices.Contains(mqttSchemes, u.Scheme) || (u.Host == "" && u.Scheme != "unix") {
+			problem("mqtt.server %q doesn't look like a broker URL, it should be something like tcp://mqtt.local:1883 (%s)", cfg.MQTT.Server, strings.Join(mqttSchemes, ", "))
+		}
+		if cfg.MQTT.Topic == "" {
+			problem("mqtt.topic is required")
+		}
+		if strings.ContainsAny(cfg.MQTT.PublishTopic, "+#") {
+			problem("mqtt.publishTopic can't have wildcards (+ or #) in it")
+		}
+		if cfg.MQTT.QoS < 0 || cfg.MQTT.QoS > 2 {
+			problem("mqtt.qos has to be 0, 1 or 2, not %d", cfg.MQTT.QoS)
+		}
+		if (cfg.MQTT.ClientCert == "") != (cfg.MQTT.ClientKey == "") {
+			problem("mqtt.clientCert and mqtt.clientKey go together, set both or neither")
+		} else if _, err := cfg.MQTT.TLSConfig(); err != nil {
+			problem("mqtt TLS settings: %v", err)
+		}
+	}
+
+	if cfg.Broker.Enabled {
+		if _, _, err := net.SplitHostPort(cfg.Broker.Address); err != nil {
+			problem("broker.address %q should be something like :1883", cfg.Broker.Address)
+		}
+		if cfg.Broker.Username == "" && cfg.Broker.Password != "" {
+			problem("broker.password needs a broker.username to go with it")
+		}
+	}
+
+	if cfg.Serial.Enabled {
+		if cfg.Serial.Device == "" {
+			problem("serial.device is required (something like /dev/ttyUSB0)")
+		}
+		if cfg.Serial.BaudRate < 0 {
+			problem("serial.baudRate can't be negative")
+		}
+		if _, _, _, err := cfg.Serial.Pattern(); err != nil {
+			problem("serial.lineRegex: %v", err)
+		}
+	}
+
+	if cfg.Discord.Enabled {
+		if cfg.Discord.BotToken == "" {
+			problem("discord.botToken is required (from the Discord Developer Portal)")
+		}
+		if cfg.Discord.AppToken == "" {
+			problem("discord.appToken is required (the application ID from the Discord Developer Portal)")
+		} else if !isSnowflake(cfg.Discord.AppToken) {
+			problem("discord.appToken should be the numeric application ID, not %q", cfg.Discord.AppToken)
+		}
+		if cfg.Discord.ChannelID == "" {
+			problem("discord.channelId is required, it's where alerts get posted")
+		}
+	}
+	for name, id := range map[string]string{
+		"discord.guildId":         cfg.Discord.GuildID,
+		"discord.channelId":       cfg.Discord.ChannelID,
+		"discord.userId":          cfg.Discord.UserID,
+		"alerts.escalationUserId": cfg.Alerts.EscalationUserID,
+		"alerts.escalationRoleId": cfg.Alerts.EscalationRoleID,
+	} {
+		if id != "" && !isSnowflake(id) {
+			problem("%s should be a numeric Discord ID (turn on Developer Mode and use Copy ID), not %q", name, id)
+		}
+	}
+
+	if cfg.HomeAssistant.Enabled {
+		if !cfg.MQTT.Enabled {
+			problem("homeAssistant needs mqtt turned on")
+		}
+		if cfg.MQTT.PublishTopic == "" {
+			problem("homeAssistant needs mqtt.publishTopic set, that's where its sensors read from")
+		}
+		if cfg.HomeAssistant.DiscoveryPrefix == "" || cfg.HomeAssistant.NodeID == "" {
+			problem("homeAssistant.discoveryPrefix and homeAssistant.nodeId can't be empty")
+		}
+		if strings.ContainsAny(cfg.HomeAssistant.NodeID, "/+# ") {
+			problem("homeAssistant.nodeId %q should only have letters, numbers, _ and -", cfg.HomeAssistant.NodeID)
+		}
+	}
+
+	if _, err := time.LoadLocation(cfg.Display.Timezone); err != nil || cfg.Display.Timezone == "" {
+		problem("display.timezone %q isn't a timezone, it should be something like America/Chicago", cfg.Display.Timezone)
+	}
+	if cfg.Display.TimeFormat == "" {
+		problem("display.timeFormat can't be empty, the default is %q", defaultTimeFormat)
+	}
+
+	if cfg.Web.Enabled && (cfg.Web.Port < 1 || cfg.Web.Port > 65535) {
+		problem("web.port must be between 1 and 65535, not %d", cfg.Web.Port)
+	}
+	if cfg.Monitor.Enabled && cfg.Monitor.Interval.Duration <= 0 {
+		problem("monitor.interval must be more than zero")
+	}
+
+	a := cfg.Alerts
+	for name, pct := range map[string]float64{"alerts.lowThreshold": a.LowThreshold, "alerts.criticalThreshold": a.CriticalThreshold} {
+		if pct < 0 || pct > 100 {
+			problem("%s is a percentage, it must be between 0 and 100, not %g", name, pct)
+		}
+	}
+	if a.CriticalThreshold > a.LowThreshold {
+		problem("alerts.criticalThreshold (%g) should be lower than alerts.lowThreshold (%g)", a.CriticalThreshold, a.LowThreshold)
+	}
+	if a.CalibrationMonths < 0 {
+		problem("alerts.calibrationMonths can't be negative, use 0 to never be reminded")
+	}
+	for name, d := range map[string]Duration{
+		"alerts.renotifyEvery":    a.RenotifyEvery,
+		"alerts.escalateAfter":    a.EscalateAfter,
+		"alerts.supplierLeadTime": a.SupplierLeadTime,
+		"alerts.safetyMargin":     a.SafetyMargin,
+	} {
+		if d.Duration < 0 {
+			problem("%s can't be negative", name)
+		}
+	}
+
+	// Maps don't have an order, so keep the report stable
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+	return errors.Join(errs...)
+}
+
+// The URL schemes the MQTT client knows how to connect with
+var mqttSchemes = []string{"tcp", "mqtt", "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "ws", "wss", "unix"}
+
+// Discord IDs ("snowflakes") are all digits
+func isSnowflake(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// BuildConfig puts together the config from the defaults, the config file
+// at path and the environment, and checks it makes sense. A missing config
+// file is only a problem if required is set. override, if there is one,
+// gets the last word before it's checked.
+func BuildConfig(path string, required bool, override func(*AppConfig)) (AppConfig, error) {
+	cfg := DefaultConfig()
+	var problems []error
+	if err := LoadConfig(path, &cfg); err != nil {
+		if required || !errors.Is(err, os.ErrNotExist) {
+			problems = append(problems, err)
+		} else {
+			log.Printf("No %s, using defaults and the environment\n", path)
+		}
+	}
+	problems = append(problems, ApplyEnv(&cfg))
+	if override != nil {
+		override(&cfg)
+	}
+	cfg.useBroker()
+	problems = append(problems, cfg.Validate())
+	return cfg, errors.Join(problems...)
+}
+
+// useBroker points the bot at the built-in broker, unless mqtt.server
+// points it somewhere else
+func (cfg *AppConfig) useBroker() {
+	if !cfg.Broker.Enabled || cfg.MQTT.Server != "" {
+		return
+	}
+	cfg.MQTT.Server = cfg.Broker.LocalURL()
+	if cfg.MQTT.Username == "" {
+		cfg.MQTT.Username, cfg.MQTT.Password = cfg.Broker.Username, cfg.Broker.Password
+	}
+}
+
+// WatchConfig watches the config file and, whenever it changes to
+// something valid, logs what changed and hands the old and new config to
+// apply. Broken edits are logged and otherwise ignored. override is passed
+// on to BuildConfig.
+func WatchConfig(ctx context.Context, path string, current AppConfig, override func(*AppConfig), apply func(old, new AppConfig)) func() error {
+	return func() error {
+		// A config file that doesn't exist yet gets picked up when it does
+		return watchFile(ctx, path, fileSettleTime, func() {
+			cfg, err := BuildConfig(path, true, override)
+			if err != nil {
+				log.Printf("Ignoring changes to %s, there are problems with it:\n  - %s\n", path, strings.ReplaceAll(err.Error(), "\n", "\n  - "))
+				return
+			}
+			changes := diffConfig(reflect.ValueOf(current), reflect.ValueOf(cfg), "")
+			if len(changes) == 0 {
+				return
+			}
+			log.Printf("%s changed:\n  %s\n", path, strings.Join(changes, "\n  "))
+			apply(current, cfg)
+			current = cfg
+		})
+	}
+}
+
+// diffConfig lists the settings that differ between old and new, keeping
+// secrets out of the log
+func diffConfig(old, new reflect.Value, prefix string) []string {
+	var changes []string
+	t := old.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + tag
+		o, n := old.Field(i), new.Field(i)
+
+		if o.Kind() == reflect.Struct && o.Type() != reflect.TypeFor[Duration]() {
+			changes = append(changes, diffConfig(o, n, name+".")...)
+			continue
+		}
+		if o.Equal(n) {
+			continue
+		}
+		if lower := strings.ToLower(tag); strings.Contains(lower, "token") || strings.Contains(lower, "password") {
+			changes = append(changes, name+" changed")
+		} else {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", name, o.Interface(), n.Interface()))
+		}
+	}
+	return changes
+}
+
+// ApplyEnv overrides the config with any PROPANEBOT_* environment
+// variables that are set
+func ApplyEnv(cfg *AppConfig) error {
+	return applyEnv(reflect.ValueOf(cfg).Elem(), envPrefix)
+}
+
+func applyEnv(v reflect.Value, prefix string) error {
+	var errs []error
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct && field.Type() != reflect.TypeFor[Duration]() {
+			errs = append(errs, applyEnv(field, name))
+			continue
+		}
+
+		value, ok, err := lookupEnv(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if err := setField(field, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		log.Printf("Using %s from the environment\n", name)
+	}
+	return errors.Join(errs...)
+}
+
+// lookupEnv gets the value of the variable, or the contents of the file
+// named by its _FILE variant
+func lookupEnv(name string) (string, bool, error) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true, nil
+	}
+	path, ok := os.LookupEnv(name + "_FILE")
+	if !ok {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	// Secrets files usually end with a newline nobody meant to be there
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+func setField(field reflect.Value, value string) error {
+	if d, ok := field.Addr().Interface().(*Duration); ok {
+		return d.parse(value)
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("can't set a %s from the environment", field.Type())
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A config that's good enough to run with, without Discord
+const testConfig = `{
+    "mqtt": {"server": "tcp://mqtt.local:1883", "topic": "propane/weight"},
+    "discord": {"enabled": false},
+    "monitor": {"interval": "1m"}
+}`
+
+func writeTestConfig(t *testing.T, path, config string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Defaults, then the file, then the environment
+func TestBuildConfigLayers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeTestConfig(t, path, testConfig)
+	t.Setenv("PROPANEBOT_MONITOR_INTERVAL", "2m")
+	t.Setenv("PROPANEBOT_ALERTS_LOWTHRESHOLD", "30")
+
+	cfg, err := BuildConfig(path, true, nil)
+	if err != nil {
+		t.Fatalf("BuildConfig() error = %v", err)
+	}
+	// From the defaults
+	if cfg.Web.Port != 9991 || cfg.Alerts.CriticalThreshold != 10 {
+		t.Errorf("web.port = %d and alerts.criticalThreshold = %g, want the defaults", cfg.Web.Port, cfg.Alerts.CriticalThreshold)
+	}
+	// From the file
+	if cfg.MQTT.Server != "tcp://mqtt.local:1883" || cfg.Discord.Enabled {
+		t.Errorf("mqtt.server = %q and discord.enabled = %v, want what's in the file", cfg.MQTT.Server, cfg.Discord.Enabled)
+	}
+	// The environment beats the file, and the defaults
+	if cfg.Monitor.Interval.Duration != 2*time.Minute || cfg.Alerts.LowThreshold != 30 {
+		t.Errorf("monitor.interval = %s and alerts.lowThreshold = %g, want what's in the environment", cfg.Monitor.Interval, cfg.Alerts.LowThreshold)
+	}
+}
+
+func TestBuildConfigMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("PROPANEBOT_MQTT_SERVER", "tcp://mqtt.local:1883")
+	t.Setenv("PROPANEBOT_MQTT_TOPIC", "propane/weight")
+	t.Setenv("PROPANEBOT_DISCORD_ENABLED", "false")
+
+	// Fine if everything is in the environment, unless it was asked for
+	if _, err := BuildConfig(path, false, nil); err != nil {
+		t.Errorf("BuildConfig() error = %v, want none without a config file", err)
+	}
+	if _, err := BuildConfig(path, true, nil); err == nil {
+		t.Errorf("BuildConfig() should fail when the config file it was given is missing")
+	}
+}
+
+func TestApplyEnvFile(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "bot_token")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("from a file", func(t *testing.T) {
+		t.Setenv("PROPANEBOT_DISCORD_BOTTOKEN_FILE", secret)
+		cfg := DefaultConfig()
+		if err := ApplyEnv(&cfg); err != nil {
+			t.Fatalf("ApplyEnv() error = %v", err)
+		}
+		// Without the newline on the end
+		if cfg.Discord.BotToken != "s3cret" {
+			t.Errorf("discord.botToken = %q, want the contents of the file", cfg.Discord.BotToken)
+		}
+	})
+	t.Run("the variable wins", func(t *testing.T) {
+		t.Setenv("PROPANEBOT_DISCORD_BOTTOKEN_FILE", secret)
+		t.Setenv("PROPANEBOT_DISCORD_BOTTOKEN", "direct")
+		cfg := DefaultConfig()
+		if err := ApplyEnv(&cfg); err != nil {
+			t.Fatalf("ApplyEnv() error = %v", err)
+		}
+		if cfg.Discord.BotToken != "direct" {
+			t.Errorf("discord.botToken = %q, want the variable's value", cfg.Discord.BotToken)
+		}
+	})
+	t.Run("missing file", func(t *testing.T) {
+		t.Setenv("PROPANEBOT_DISCORD_BOTTOKEN_FILE", filepath.Join(dir, "nope"))
+		cfg := DefaultConfig()
+		err := ApplyEnv(&cfg)
+		if err == nil || !strings.Contains(err.Error(), "PROPANEBOT_DISCORD_BOTTOKEN_FILE") {
+			t.Errorf("ApplyEnv() error = %v, want one naming the variable", err)
+		}
+	})
+	t.Run("bad value", func(t *testing.T) {
+		t.Setenv("PROPANEBOT_WEB_PORT", "lots")
+		cfg := DefaultConfig()
+		err := ApplyEnv(&cfg)
+		if err == nil || !strings.Contains(err.Error(), "PROPANEBOT_WEB_PORT") {
+			t.Errorf("ApplyEnv() error = %v, want one naming the variable", err)
+		}
+	})
+}
+
+func TestLoadConfigUnknownKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{"all known", testConfig, nil},
+		{"typo", `{"mqtt": {"sever": "tcp://mqtt.local:1883"}}`, []string{`unknown setting "mqtt.sever"`}},
+		{"wrong case", `{"discord": {"BotToken": "x"}}`, []string{`unknown setting "discord.BotToken" (did you mean "discord.botToken"?)`}},
+		{"unknown section", `{"slack": {}}`, []string{`unknown setting "slack"`}},
+		{"several", `{"web": {"prot": 80}, "alerts": {"low": 5}}`, []string{`unknown setting "alerts.low"`, `unknown setting "web.prot"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			writeTestConfig(t, path, tt.config)
+			cfg := DefaultConfig()
+			err := LoadConfig(path, &cfg)
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("LoadConfig() error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("LoadConfig() should have failed")
+			}
+			var got []string
+			for _, line := range strings.Split(err.Error(), "\n") {
+				got = append(got, strings.TrimPrefix(line, path+": "))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("LoadConfig() errors = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() AppConfig {
+		cfg := DefaultConfig()
+		cfg.MQTT.Server = "tcp://mqtt.local:1883"
+		cfg.MQTT.Topic = "propane/weight"
+		cfg.Discord.Enabled = false
+		return cfg
+	}
+	tests := []struct {
+		name   string
+		change func(*AppConfig)
+		want   []string
+	}{
+		{"valid", func(*AppConfig) {}, nil},
+		{"no broker", func(cfg *AppConfig) { cfg.MQTT.Server = "" }, []string{"mqtt.server is required"}},
+		{"bad broker", func(cfg *AppConfig) { cfg.MQTT.Server = "mqtt.local" }, []string{`mqtt.server "mqtt.local" doesn't look like a broker URL`}},
+		{"bad qos", func(cfg *AppConfig) { cfg.MQTT.QoS = 3 }, []string{"mqtt.qos has to be 0, 1 or 2, not 3"}},
+		{"discord", func(cfg *AppConfig) {
+			cfg.Discord.Enabled = true
+			cfg.Discord.AppToken = "abc"
+		}, []string{
+			"discord.appToken should be the numeric application ID",
+			"discord.botToken is required",
+			"discord.channelId is required",
+		}},
+		{"mqtt off", func(cfg *AppConfig) {
+			cfg.MQTT = MQTTConfig{}
+			cfg.Web.Port = 0
+		}, []string{"web.port must be between 1 and 65535, not 0"}},
+		{"thresholds", func(cfg *AppConfig) {
+			cfg.Alerts.LowThreshold = 5
+			cfg.Alerts.CriticalThreshold = 120
+		}, []string{
+			"alerts.criticalThreshold (120) should be lower than alerts.lowThreshold (5)",
+			"alerts.criticalThreshold is a percentage, it must be between 0 and 100, not 120",
+		}},
+		{"timezone", func(cfg *AppConfig) { cfg.Display.Timezone = "Chicago" }, []string{`display.timezone "Chicago" isn't a timezone`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.change(&cfg)
+			err := cfg.Validate()
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() should have failed")
+			}
+			got := strings.Split(err.Error(), "\n")
+			if len(got) != len(tt.want) {
+				t.Fatalf("Validate() errors = %q, want %d of them", got, len(tt.want))
+			}
+			for i := range got {
+				if !strings.HasPrefix(got[i], tt.want[i]) {
+					t.Errorf("Validate() error %d = %q, want it to start with %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	old := DefaultConfig()
+	new := old
+	new.Monitor.Interval = Duration{time.Minute}
+	new.Discord.BotToken = "s3cret"
+	new.MQTT.Password = "hunter2"
+	new.Web.IngestToken = "t0ken"
+
+	got := diffConfig(reflect.ValueOf(old), reflect.ValueOf(new), "")
+	want := []string{
+		"mqtt.password changed",
+		"discord.botToken changed",
+		"web.ingestToken changed",
+		"monitor.interval: 10s -> 1m0s",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("diffConfig() = %q, want %q", got, want)
+	}
+	for _, secret := range []string{"s3cret", "hunter2", "t0ken"} {
+		if strings.Contains(strings.Join(got, "\n"), secret) {
+			t.Errorf("diffConfig() gave away %q", secret)
+		}
+	}
+}
+
+// Only valid changes are applied, and each one is compared to the last
+// one that was
+func TestWatchConfigChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeTestConfig(t, path, testConfig)
+	current, err := BuildConfig(path, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type change struct{ old, new AppConfig }
+	applied := make(chan change, 1)
+	go WatchConfig(ctx, path, current, nil, func(old, new AppConfig) { applied <- change{old, new} })()
+	time.Sleep(50 * time.Millisecond)
+	next := func() (change, bool) {
+		select {
+		case c := <-applied:
+			return c, true
+		case <-time.After(fileSettleTime + 500*time.Millisecond):
+			return change{}, false
+		}
+	}
+
+	// Saving it without changing anything doesn't count
+	writeTestConfig(t, path, testConfig)
+	if _, ok := next(); ok {
+		t.Errorf("saving the same config shouldn't apply it")
+	}
+
+	// Broken edits are ignored
+	writeTestConfig(t, path, strings.Replace(testConfig, `"1m"`, `"a while"`, 1))
+	if _, ok := next(); ok {
+		t.Errorf("a broken config shouldn't be applied")
+	}
+
+	// Only what changed is different
+	writeTestConfig(t, path, strings.Replace(testConfig, `"1m"`, `"5m"`, 1))
+	c, ok := next()
+	if !ok {
+		t.Fatal("the change wasn't applied")
+	}
+	if c.new.Monitor.Interval.Duration != 5*time.Minute {
+		t.Errorf("monitor.interval = %s, want 5m", c.new.Monitor.Interval)
+	}
+	if changes := diffConfig(reflect.ValueOf(c.old), reflect.ValueOf(c.new), ""); !slices.Equal(changes, []string{"monitor.interval: 1m0s -> 5m0s"}) {
+		t.Errorf("the changes are %q, want just monitor.interval", changes)
+	}
+
+	// And the next change is compared to that one
+	writeTestConfig(t, path, strings.Replace(testConfig, `"discord": {"enabled": false}`, `"discord": {"enabled": false, "userId": "1234"}`, 1))
+	c, ok = next()
+	if !ok {
+		t.Fatal("the second change wasn't applied")
+	}
+	if changes := diffConfig(reflect.ValueOf(c.old), reflect.ValueOf(c.new), ""); !slices.Equal(changes, []string{"discord.userId:  -> 1234", "monitor.interval: 5m0s -> 1m0s"}) {
+		t.Errorf("the changes are %q, want discord.userId and monitor.interval back to 1m", changes)
+	}
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"log"
 	"math"
 	"os"
 	"sync"
-
-	"github.com/fsnotify/fsnotify"
+	"time"
 )
 
 // The purpose of this file is to store the base weight (tare)
@@ -28,113 +29,257 @@ type Cylinder struct {
 	ExtraWeight float64 `json:"extraweight"`
 }
 
-var (
-	cylinder   Cylinder
-	cylinderMu sync.RWMutex
-)
+// Validate checks the weights make enough sense to work out a percentage
+// from
+func (c Cylinder) Validate() error {
+	var errs []error
+	for _, w := range []struct {
+		name   string
+		weight float64
+	}{{"tareweight", c.TareWeight}, {"fullweight", c.FullWeight}, {"extraweight", c.ExtraWeight}} {
+		if math.IsNaN(w.weight) || math.IsInf(w.weight, 0) || w.weight < 0 || w.weight > maxWeight {
+			errs = append(errs, fmt.Errorf("a %s of %v lbs doesn't make sense", w.name, w.weight))
+		}
+	}
+	if len(errs) == 0 && c.FullWeight <= c.TareWeight {
+		errs = append(errs, errors.New("fullweight has to be more than tareweight"))
+	}
+	return errors.Join(errs...)
+}
+
+// CylinderSettings is wherever the cylinder's weights are kept, so tests
+// can use their own instead of cylinder.json
+type CylinderSettings interface {
+	Get() Cylinder
+	Save(c Cylinder) error
+}
+
+// CylinderStore keeps the cylinder settings in a JSON file (cylinder.json
+// unless told otherwise), and reloads them when somebody edits it
+type CylinderStore struct {
+	path     string
+	lock     sync.RWMutex
+	cylinder Cylinder
+	// What's in the file as far as we know, so we can tell our own writes
+	// from somebody else's edits
+	contents []byte
+	// When the file was last loaded, and what went wrong if the last try
+	// didn't work, for /readyz
+	loaded time.Time
+	err    error
+	// Called whenever the settings change
+	onChange []func()
+}
+
+// NewCylinderStore loads the cylinder settings kept at path. If they can't
+// be loaded that's logged (and shows up in Health), and they're all zero
+// until they can be.
+func NewCylinderStore(path string) *CylinderStore {
+	s := &CylinderStore{path: path}
+	s.Load()
+	return s
+}
+
+// OnChange adds a function to call whenever the settings change, whether
+// that's from Save or somebody editing the file
+func (s *CylinderStore) OnChange(f func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.onChange = append(s.onChange, f)
+}
 
-func LoadCylinderData() {
-	log.Println("Loading current cylinder info")
-	jsonFile, err := os.Open(cylinderFile)
+// changed calls the OnChange functions. Must be called without the lock
+// held, since they'll probably want to Get the new settings.
+func (s *CylinderStore) changed() {
+	s.lock.RLock()
+	onChange := s.onChange
+	s.lock.RUnlock()
+	for _, f := range onChange {
+		f()
+	}
+}
+
+// Load (re)reads the settings from the file. Settings that don't make
+// sense are ignored, keeping the ones we had.
+func (s *CylinderStore) Load() error {
+	data, err := os.ReadFile(s.path)
+
+	s.lock.Lock()
+	if err == nil && s.contents != nil && bytes.Equal(data, s.contents) {
+		// Nothing new, probably because we just saved it
+		s.err = nil
+		s.lock.Unlock()
+		return nil
+	}
+	log.Printf("Loading current cylinder info from %s\n", s.path)
+	var c Cylinder
+	if err == nil {
+		c, err = s.parse(data)
+	}
+	s.err = err
 	if err != nil {
+		s.lock.Unlock()
 		log.Println(err)
-		return
+		return err
 	}
-	defer jsonFile.Close()
+	different := c != s.cylinder
+	s.cylinder = c
+	s.contents = data
+	s.loaded = time.Now()
+	s.lock.Unlock()
 
-	byteValue, err := io.ReadAll(jsonFile)
-	if err != nil {
-		log.Printf("Failed to read cylinder data: %s\n", err)
-		return
+	if different {
+		s.changed()
 	}
+	return nil
+}
 
+func (s *CylinderStore) parse(data []byte) (Cylinder, error) {
 	var c Cylinder
-	if err := json.Unmarshal(byteValue, &c); err != nil {
-		log.Printf("Failed to parse cylinder data: %s\n", err)
-		return
+	if err := json.Unmarshal(data, &c); err != nil {
+		return Cylinder{}, fmt.Errorf("failed to parse %s: %w", s.path, err)
 	}
-
-	cylinderMu.Lock()
-	cylinder = c
-	cylinderMu.Unlock()
+	if err := c.Validate(); err != nil {
+		return Cylinder{}, fmt.Errorf("%s: %w", s.path, err)
+	}
+	return c, nil
 }
 
-// GetCylinderData returns a copy of the currently loaded cylinder settings
-func GetCylinderData() Cylinder {
-	cylinderMu.RLock()
-	defer cylinderMu.RUnlock()
-	return cylinder
+// Get returns a copy of the currently loaded cylinder settings
+func (s *CylinderStore) Get() Cylinder {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.cylinder
 }
 
-// SaveCylinderData writes the given cylinder settings to cylinder.json and
-// updates the in-memory copy used for calculations
-func SaveCylinderData(c Cylinder) error {
+// Save checks the given cylinder settings, writes them to the file and
+// starts using them
+func (s *CylinderStore) Save(c Cylinder) error {
+	if err := c.Validate(); err != nil {
+		return err
+	}
 	data, err := json.MarshalIndent(c, "", "    ")
 	if err != nil {
 		return err
 	}
 
-	if err := os.WriteFile(cylinderFile, data, 0644); err != nil {
+	s.lock.Lock()
+	if err := writeFileAtomic(s.path, data, 0644); err != nil {
+		s.lock.Unlock()
 		return err
 	}
+	different := c != s.cylinder
+	s.cylinder = c
+	s.contents = data
+	s.loaded = time.Now()
+	s.err = nil
+	s.lock.Unlock()
 
-	cylinderMu.Lock()
-	cylinder = c
-	cylinderMu.Unlock()
-
+	if different {
+		s.changed()
+	}
 	return nil
 }
 
-// WatchCylinderData watches cylinder.json on disk and reloads it into memory
-// whenever it changes, so edits made outside the web page (or by the web
-// page's handler writing the file directly) are picked up automatically.
-func WatchCylinderData(ctx context.Context) func() error {
-	return func() error {
-		watcher, err := fsnotify.NewWatcher()
-		if err != nil {
-			return err
-		}
-		defer watcher.Close()
-
-		if err := watcher.Add(cylinderFile); err != nil {
-			return err
-		}
+// Health is the health check for the cylinder settings: they have to have
+// loaded, and make enough sense to work out a percentage from
+func (s *CylinderStore) Health() (bool, any) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	details := struct {
+		Path     string    `json:"path"`
+		Loaded   bool      `json:"loaded"`
+		LoadedAt time.Time `json:"loadedAt,omitzero"`
+		Valid    bool      `json:"valid"`
+		Error    string    `json:"error,omitempty"`
+	}{
+		Path:     s.path,
+		Loaded:   !s.loaded.IsZero(),
+		LoadedAt: s.loaded,
+		Valid:    s.cylinder.Validate() == nil,
+	}
+	if s.err != nil {
+		details.Error = s.err.Error()
+	}
+	return details.Loaded && details.Valid && s.err == nil, details
+}
 
-		for {
-			select {
-			case <-ctx.Done():
-				return nil
-			case event, ok := <-watcher.Events:
-				if !ok {
-					return nil
-				}
-				if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) {
-					LoadCylinderData()
-				}
-				// Some editors/writers replace the file instead of writing
-				// in place, which drops the watch and needs it re-added.
-				if event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
-					_ = watcher.Add(cylinderFile)
-					LoadCylinderData()
-				}
-			case err, ok := <-watcher.Errors:
-				if !ok {
-					return nil
-				}
-				log.Printf("cylinder.json watcher error: %v", err)
-			}
-		}
+// Watch watches the file and reloads it whenever somebody else changes
+// it, so edits made outside the web page are picked up automatically.
+func (s *CylinderStore) Watch(ctx context.Context) func() error {
+	return func() error {
+		return watchFile(ctx, s.path, fileSettleTime, func() { s.Load() })
 	}
 }
 
 // Gives us the percentage remaining for the given weight, taking into
 // consideration the full and tare weight of the cylinder, plus any extra
-// weight that might be on the scale
+// weight that might be on the scale. It's kept between 0 and 100, State
+// says when the weight is too far outside that to mean anything.
 func (c Cylinder) CalcRemaining(currentWeight float64) float64 {
-	cur := GetCylinderData()
-	base := cur.FullWeight - cur.TareWeight + cur.ExtraWeight
-	adjusted := currentWeight - cur.TareWeight + cur.ExtraWeight
+	base := c.FullWeight - c.TareWeight + c.ExtraWeight
+	adjusted := currentWeight - c.TareWeight + c.ExtraWeight
 	delta := math.Round((adjusted / base) * 100)
 
-	return delta
+	return min(max(delta, 0), 100)
+}
+
+// TankState is what the weight on the scale says about the cylinder, for
+// when it's not just a matter of how full it is
+type TankState string
+
+const (
+	// The weight makes sense for the cylinder we've got
+	TankOK TankState = "ok"
+	// Not even half what an empty cylinder weighs, so there's nothing on
+	// the scale (probably in the middle of a swap)
+	TankNoCylinder TankState = "nocylinder"
+	// More than a full cylinder weighs: it's been overfilled, it's a
+	// different cylinder, or somebody's leaning on the scale
+	TankOverFull TankState = "overfull"
+	// Less than an empty cylinder weighs, so the tare weight is off
+	TankBelowTare TankState = "belowtare"
+)
+
+// How far past empty or full the weight can be before it's more than the
+// scale being a bit off, as a fraction of what the cylinder holds
+const tankSlack = 0.05
+
+// State works out whether the weight makes sense for the cylinder
+func (c Cylinder) State(currentWeight float64) TankState {
+	// Where CalcRemaining says 0%
+	empty := c.TareWeight - c.ExtraWeight
+	slack := tankSlack * (c.FullWeight - c.TareWeight)
+	switch {
+	case currentWeight < empty/2:
+		return TankNoCylinder
+	case currentWeight < empty-slack:
+		return TankBelowTare
+	case currentWeight > c.FullWeight+slack:
+		return TankOverFull
+	}
+	return TankOK
+}
+
+// Describe says what the state means, for showing people
+func (s TankState) Describe() string {
+	switch s {
+	case TankNoCylinder:
+		return "no cylinder on the scale"
+	case TankOverFull:
+		return "over full"
+	case TankBelowTare:
+		return "below tare"
+	}
+	return "ok"
+}
+
+// The weight jumping up by at least this many lbs means somebody put a
+// fresh cylinder on the scale
+const refillJump = 20.0
+
+// Refilled says whether going from previous to current lbs looks like a
+// new cylinder
+func Refilled(previous, current float64) bool {
+	return current-previous >= refillJump
 }
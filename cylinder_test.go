@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A 100 lb cylinder that weighs 60 lbs empty
+var testCylinder = Cylinder{TareWeight: 60, FullWeight: 160}
+
+// newTestCylinderStore makes a CylinderStore for testCylinder in a temp dir
+func newTestCylinderStore(t *testing.T) *CylinderStore {
+	t.Helper()
+	s := NewCylinderStore(filepath.Join(t.TempDir(), cylinderFile))
+	if err := s.Save(testCylinder); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCalcRemaining(t *testing.T) {
+	tests := []struct {
+		name   string
+		weight float64
+		want   float64
+	}{
+		{"full", 160, 100},
+		{"empty", 60, 0},
+		{"half", 110, 50},
+		{"rounds", 123.456, 63},
+		{"over full", 175, 100},
+		{"below tare", 45, 0},
+		{"nothing on the scale", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testCylinder.CalcRemaining(tt.weight); got != tt.want {
+				t.Errorf("CalcRemaining(%v) = %v, want %v", tt.weight, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCylinderState(t *testing.T) {
+	withExtra := Cylinder{TareWeight: 60, FullWeight: 160, ExtraWeight: 10}
+	tests := []struct {
+		name     string
+		cylinder Cylinder
+		weight   float64
+		want     TankState
+	}{
+		{"full", testCylinder, 160, TankOK},
+		{"empty", testCylinder, 60, TankOK},
+		{"a bit over full", testCylinder, 164, TankOK},
+		{"over full", testCylinder, 166, TankOverFull},
+		{"a bit under empty", testCylinder, 56, TankOK},
+		{"below tare", testCylinder, 54, TankBelowTare},
+		{"nothing on the scale", testCylinder, 0.3, TankNoCylinder},
+		{"just the hose on the scale", testCylinder, 8, TankNoCylinder},
+		// Empty is 50 lbs with the extra weight
+		{"empty with extra weight", withExtra, 50, TankOK},
+		{"below tare with extra weight", withExtra, 44, TankBelowTare},
+		{"nothing on the scale with extra weight", withExtra, 24, TankNoCylinder},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cylinder.State(tt.weight); got != tt.want {
+				t.Errorf("State(%v) = %q, want %q", tt.weight, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCylinderValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		cylinder Cylinder
+		wantErr  string
+	}{
+		{"fine", testCylinder, ""},
+		{"full less than tare", Cylinder{TareWeight: 60, FullWeight: 50}, "more than tareweight"},
+		{"nothing set", Cylinder{}, "more than tareweight"},
+		{"negative", Cylinder{TareWeight: -1, FullWeight: 50}, "tareweight of -1"},
+		{"ridiculous", Cylinder{TareWeight: 60, FullWeight: 5000}, "fullweight of 5000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cylinder.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Validate() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Validate() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCylinderStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tank.json")
+	s := NewCylinderStore(path)
+	if ready, _ := s.Health(); ready {
+		t.Errorf("a store with no file shouldn't be ready")
+	}
+
+	if err := s.Save(testCylinder); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if ready, details := s.Health(); !ready {
+		t.Errorf("the store should be ready after saving, got %+v", details)
+	}
+
+	// Another store for the same file sees the same settings, and one for a
+	// different file doesn't
+	if got := NewCylinderStore(path).Get(); got != testCylinder {
+		t.Errorf("loaded %+v, want %+v", got, testCylinder)
+	}
+	if got := NewCylinderStore(filepath.Join(t.TempDir(), "other.json")).Get(); got != (Cylinder{}) {
+		t.Errorf("a store for another file loaded %+v", got)
+	}
+
+	if err := s.Save(Cylinder{TareWeight: 60}); err == nil {
+		t.Errorf("Save() should refuse settings that don't make sense")
+	}
+	if got := s.Get(); got != testCylinder {
+		t.Errorf("a refused Save() changed the settings to %+v", got)
+	}
+
+	// A bad edit to the file is ignored, keeping what we had
+	if err := os.WriteFile(path, []byte(`{"tareweight": 60, "fullweight": 10}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Load(); err == nil {
+		t.Errorf("Load() should complain about the bad edit")
+	}
+	if got := s.Get(); got != testCylinder {
+		t.Errorf("a bad edit changed the settings to %+v", got)
+	}
+	if ready, _ := s.Health(); ready {
+		t.Errorf("the store shouldn't be ready after a bad edit")
+	}
+}
+
+func TestCylinderStoreWatch(t *testing.T) {
+	s := newTestCylinderStore(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Watch(ctx)()
+	time.Sleep(50 * time.Millisecond)
+	loadedAt := func() time.Time {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		return s.loaded
+	}
+
+	// Our own saves don't get reloaded
+	small := Cylinder{TareWeight: 17, FullWeight: 37}
+	if err := s.Save(small); err != nil {
+		t.Fatal(err)
+	}
+	saved := loadedAt()
+	time.Sleep(fileSettleTime + 200*time.Millisecond)
+	if !loadedAt().Equal(saved) {
+		t.Errorf("the store reloaded its own save")
+	}
+
+	// Somebody else's edits do
+	if err := os.WriteFile(s.path, []byte(`{"tareweight": 60, "fullweight": 160}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the edit to be picked up", func() bool { return s.Get() == testCylinder })
+}
+
+func TestCylinderStoreOnChange(t *testing.T) {
+	s := newTestCylinderStore(t)
+	var changes atomic.Int32
+	s.OnChange(func() { changes.Add(1) })
+
+	small := Cylinder{TareWeight: 17, FullWeight: 37}
+	if err := s.Save(small); err != nil {
+		t.Fatal(err)
+	}
+	if got := changes.Swap(0); got != 1 {
+		t.Errorf("saving new settings made %d calls, want 1", got)
+	}
+
+	// Saving the same thing again, or loading the file we just saved, isn't
+	// a change
+	if err := s.Save(small); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := changes.Swap(0); got != 0 {
+		t.Errorf("nothing changed, but there were %d calls", got)
+	}
+
+	// Somebody else's edit is
+	if err := os.WriteFile(s.path, []byte(`{"tareweight": 60, "fullweight": 160}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := changes.Swap(0); got != 1 {
+		t.Errorf("loading an edit made %d calls, want 1", got)
+	}
+}
@@ -9,44 +9,149 @@ import (
 type CurrentData struct {
 	Weight    float64
 	TimeStamp time.Time
-	// We'll calculate this when setting so the
-	// bot doesn't have to
+	// Worked out from the weight whenever the data is read, so they're
+	// always using the latest cylinder settings
 	Remaining float64
+	State     TankState
+}
+
+// ReadingSource is where the latest reading can be had from. That's the
+// Datastore, or something made up in tests.
+type ReadingSource interface {
+	Get() CurrentData
+	GetString() string
+	Watch() (<-chan CurrentData, func())
 }
 
 type Datastore struct {
 	data CurrentData
-	lock *sync.RWMutex
+	// For working out the percent remaining
+	cylinder CylinderSettings
+	lock     *sync.RWMutex
+	// Everyone who wants to hear about new data
+	watchers map[chan CurrentData]struct{}
+	// For saying how long ago the reading was, nil for the bot's clock
+	clock Clock
 }
 
-func NewDatastore() *Datastore {
+func NewDatastore(cyl CylinderSettings) *Datastore {
 	return &Datastore{
-		data: CurrentData{},
-		lock: &sync.RWMutex{},
+		data:     CurrentData{},
+		cylinder: cyl,
+		lock:     &sync.RWMutex{},
+		watchers: map[chan CurrentData]struct{}{},
+	}
+}
+
+// SetClock changes the clock used to say how long ago the reading was
+func (d *Datastore) SetClock(c Clock) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.clock = c
+}
+
+// remaining is the percent remaining, or nil if there's no cylinder on
+// the scale to have any
+func (d CurrentData) remaining() *float64 {
+	if d.State == TankNoCylinder {
+		return nil
+	}
+	return &d.Remaining
+}
+
+// Watch returns a channel that receives the data whenever it's Set or
+// Refreshed, and a function to call when you're done with it. Slow readers
+// only get the latest data, never a backlog.
+func (d *Datastore) Watch() (<-chan CurrentData, func()) {
+	ch := make(chan CurrentData, 1)
+	d.lock.Lock()
+	d.watchers[ch] = struct{}{}
+	d.lock.Unlock()
+
+	return ch, func() {
+		d.lock.Lock()
+		delete(d.watchers, ch)
+		d.lock.Unlock()
 	}
 }
 
 func (d *Datastore) Get() CurrentData {
 	d.lock.RLock()
 	defer d.lock.RUnlock()
-	return d.data
+	return d.get()
+}
+
+// Must be called with the lock held
+func (d *Datastore) get() CurrentData {
+	data := d.data
+	if !data.TimeStamp.IsZero() {
+		cyl := d.cylinder.Get()
+		data.Remaining = cyl.CalcRemaining(data.Weight)
+		data.State = cyl.State(data.Weight)
+	}
+	return data
 }
 
 func (d *Datastore) GetString() string {
 	d.lock.RLock()
-	defer d.lock.RUnlock()
+	data, now := d.get(), nowFrom(d.clock)
+	d.lock.RUnlock()
+	switch data.State {
+	case TankNoCylinder:
+		return fmt.Sprintf(
+			"Hmm, as of %s there doesn't seem to be a cylinder on the scale (it says %.0f lbs)",
+			FormatTimeAgo(data.TimeStamp, now),
+			data.Weight,
+		)
+	case TankOverFull:
+		return fmt.Sprintf(
+			"Well, as of %s the cylinder weighs %.0f lbs, which is more than a full one should. Overfilled, or do the cylinder settings need updating?",
+			FormatTimeAgo(data.TimeStamp, now),
+			data.Weight,
+		)
+	case TankBelowTare:
+		return fmt.Sprintf(
+			"Well, as of %s the cylinder weighs %.0f lbs, which is less than an empty one should. Is the tare weight right?",
+			FormatTimeAgo(data.TimeStamp, now),
+			data.Weight,
+		)
+	}
 	return fmt.Sprintf(
 		"Well, as of %s the cylinder weighs %.0f lbs which kinda translates into %.0f%% remaining",
-		d.data.TimeStamp.Format("Mon Jan _2 03:04PM 2006"),
-		d.data.Weight,
-		d.data.Remaining,
+		FormatTimeAgo(data.TimeStamp, now),
+		data.Weight,
+		data.Remaining,
 	)
 }
 
-func (d *Datastore) Set(weight float64, timestamp time.Time, remaining float64) {
+// Set stores a new reading from the scale
+func (d *Datastore) Set(weight float64, timestamp time.Time) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	d.data.Weight = weight
 	d.data.TimeStamp = timestamp
-	d.data.Remaining = remaining
+	d.notify()
+}
+
+// Refresh tells everyone watching about the data again, for when the
+// cylinder settings change and the percent remaining with them
+func (d *Datastore) Refresh() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if !d.data.TimeStamp.IsZero() {
+		d.notify()
+	}
+}
+
+// Must be called with the lock held
+func (d *Datastore) notify() {
+	data := d.get()
+	for ch := range d.watchers {
+		// Swap out whatever the watcher hasn't picked up yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- data
+	}
 }
@@ -4,6 +4,10 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -18,55 +22,378 @@ type DiscordBot struct {
 	// Channel to post proactive alerts (e.g. low propane level) to
 	ChannelID string
 	// User to @-mention in proactive alerts (Discord numeric user ID)
-	UserID    string
-	Datastore *Datastore
-	session   *discordgo.Session
+	UserID        string
+	Datastore     ReadingSource
+	Subscriptions *SubscriptionStore
+	Alerts        *AlertStore
+	Orders        *OrderStore
+	History       *ConsumptionHistory
+	session       *discordgo.Session
+	// Guards the session and the settings above, which can change when
+	// config.json does
+	lock sync.RWMutex
+	// Tells Run to reconnect with new settings
+	restart chan struct{}
+	// What the bot's status currently says, so it can be put back after
+	// reconnecting
+	presence     string
+	presenceLock sync.Mutex
+	// Whether the gateway connection is up and who we're logged in as,
+	// for /readyz
+	connected bool
+	botUser   string
 }
 
+// Discord only allows a handful of presence updates a minute, and the
+// scale reports a lot more often than that
+const presenceInterval = time.Minute
+
 // SendMessage posts a message to the bot's configured alert channel
 func (b *DiscordBot) SendMessage(message string) error {
-	if b.session == nil {
+	session, channelID := b.alertChannel()
+	if session == nil {
 		return fmt.Errorf("discord session is not running")
 	}
-	_, err := b.session.ChannelMessageSend(b.ChannelID, message)
+	_, err := session.ChannelMessageSend(channelID, message)
+	return err
+}
+
+// AlertUserID is the user to @-mention in alerts
+func (b *DiscordBot) AlertUserID() string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.UserID
+}
+
+// Reconfigure applies new settings from config.json, reconnecting to
+// Discord only if the bot's credentials or server changed
+func (b *DiscordBot) Reconfigure(cfg DiscordConfig) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	reconnect := cfg.AppToken != b.AppToken || cfg.GuildID != b.GuildID || cfg.BotToken != b.BotToken
+	b.AppToken = cfg.AppToken
+	b.GuildID = cfg.GuildID
+	b.BotToken = cfg.BotToken
+	b.ChannelID = cfg.ChannelID
+	b.UserID = cfg.UserID
+
+	if reconnect && b.restart != nil {
+		select {
+		case b.restart <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (b *DiscordBot) alertChannel() (*discordgo.Session, string) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.session, b.ChannelID
+}
+
+// SendAlert posts an alert to the alert channel with a button people can
+// press to acknowledge it, pinging the alert user and anyone mentioned
+func (b *DiscordBot) SendAlert(level AlertLevel, message string, mentions ...string) error {
+	session, channelID := b.alertChannel()
+	if session == nil {
+		return fmt.Errorf("discord session is not running")
+	}
+	if userID := b.AlertUserID(); userID != "" {
+		mentions = append([]string{fmt.Sprintf("<@%s>", userID)}, mentions...)
+	}
+	if len(mentions) > 0 {
+		message = fmt.Sprintf("Hey %s! %s", strings.Join(mentions, " "), message)
+	}
+	_, err := session.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content: message,
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{
+				Components: []discordgo.MessageComponent{
+					discordgo.Button{
+						Label:    ackLabel(level),
+						Style:    discordgo.SuccessButton,
+						CustomID: ackButtonPrefix + string(level),
+					},
+				},
+			},
+		},
+	})
+	return err
+}
+
+// SendDM sends a direct message to the given user
+func (b *DiscordBot) SendDM(userID, message string) error {
+	session, _ := b.alertChannel()
+	if session == nil {
+		return fmt.Errorf("discord session is not running")
+	}
+	channel, err := session.UserChannelCreate(userID)
+	if err != nil {
+		return err
+	}
+	_, err = session.ChannelMessageSend(channel.ID, message)
 	return err
 }
 
 func (b *DiscordBot) Run(ctx context.Context) func() error {
 	return func() error {
-		var err error
-		b.session, err = discordgo.New("Bot " + b.BotToken)
-		if err != nil {
-			return err
-		}
-		b.session.AddHandler(b.handleReady())
-		b.session.AddHandler(b.handleWeight())
-		if _, err := b.session.ApplicationCommandBulkOverwrite(b.AppToken, b.GuildID, b.buildCommands()); err != nil {
-			return err
+		for {
+			restarted, err := b.runSession(ctx)
+			if !restarted {
+				return err
+			}
+			log.Println("Discord settings changed, reconnecting")
 		}
-		if err := b.session.Open(); err != nil {
-			return err
-		}
-		defer func() { err = b.session.Close() }()
-		<-ctx.Done()
+	}
+}
+
+// runSession connects to Discord and stays connected until we're shutting
+// down or the settings change, in which case it returns true
+func (b *DiscordBot) runSession(ctx context.Context) (bool, error) {
+	b.lock.Lock()
+	if b.restart == nil {
+		b.restart = make(chan struct{}, 1)
+	}
+	restart := b.restart
+	botToken, appToken, guildID := b.BotToken, b.AppToken, b.GuildID
+	b.lock.Unlock()
+
+	session, err := discordgo.New("Bot " + botToken)
+	if err != nil {
+		return false, err
+	}
+	session.AddHandler(b.handleReady())
+	session.AddHandler(b.handleDisconnect())
+	session.AddHandler(b.handleResumed())
+	session.AddHandler(b.handleWeight())
+	session.AddHandler(b.handleSubscribe())
+	session.AddHandler(b.handleUnsubscribe())
+	session.AddHandler(b.handleAck())
+	session.AddHandler(b.handleAckButton())
+	session.AddHandler(b.handleOrder())
+	if _, err := session.ApplicationCommandBulkOverwrite(appToken, guildID, b.buildCommands()); err != nil {
+		return false, err
+	}
+	if err := session.Open(); err != nil {
+		return false, err
+	}
+
+	b.lock.Lock()
+	b.session = session
+	b.lock.Unlock()
+	defer func() {
+		b.lock.Lock()
+		b.session = nil
+		b.connected = false
+		b.lock.Unlock()
+	}()
+
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go b.updatePresence(sessionCtx, session)
+
+	select {
+	case <-ctx.Done():
 		log.Printf("DiscordBot received Done with Error %q. Shutting down.\n", ctx.Err())
-		return err
+		return false, session.Close()
+	case <-restart:
+		return true, session.Close()
 	}
 }
 
 func (b *DiscordBot) buildCommands() []*discordgo.ApplicationCommand {
+	levelChoices := []*discordgo.ApplicationCommandOptionChoice{
+		{Name: "all", Value: "all"},
+	}
+	for _, l := range alertLevels {
+		levelChoices = append(levelChoices, &discordgo.ApplicationCommandOptionChoice{Name: string(l), Value: string(l)})
+	}
+
 	return []*discordgo.ApplicationCommand{
 		{
 			Name:        "weight",
 			Description: "Get the current propane level",
 			// Options: []*discordgo.ApplicationCommandOption{},
 		},
+		{
+			Name:        "subscribe",
+			Description: "Get a DM when a propane alert goes off",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "level",
+					Description: "Which alerts you want to hear about",
+					Required:    true,
+					Choices:     levelChoices,
+				},
+			},
+		},
+		{
+			Name:        "unsubscribe",
+			Description: "Stop getting DMs for propane alerts",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "level",
+					Description: "Which alerts to stop (defaults to all of them)",
+					Choices:     levelChoices,
+				},
+			},
+		},
+		{
+			Name:        "ack",
+			Description: "Let everyone know you're handling a propane alert (e.g. you ordered the gas)",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "level",
+					Description: "Which alert you're handling (defaults to all of them)",
+					Choices:     levelChoices,
+				},
+			},
+		},
+		{
+			Name:        "order",
+			Description: "Track getting a new propane cylinder",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "status",
+					Description: "Show where the current order is at",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        string(OrderNeeded),
+					Description: "Say we need a new cylinder",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        string(OrderOrdered),
+					Description: "Say you ordered a new cylinder",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "supplier",
+							Description: "Who you ordered it from",
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "expected",
+							Description: "When it should show up (YYYY-MM-DD)",
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionNumber,
+							Name:        "cost",
+							Description: "How much it cost, in dollars",
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        string(OrderDelivered),
+					Description: "Say the new cylinder showed up",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        string(OrderInstalled),
+					Description: "Say the new cylinder is hooked up",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "cancel",
+					Description: "Cancel the current order",
+				},
+			},
+		},
 	}
 }
 
 func (b *DiscordBot) handleReady() func(*discordgo.Session, *discordgo.Ready) {
 	return func(s *discordgo.Session, r *discordgo.Ready) {
 		fmt.Printf("Bot started as: %q", r.User.String())
+		b.lock.Lock()
+		b.connected = true
+		b.botUser = r.User.String()
+		b.lock.Unlock()
+
+		// A fresh connection starts out with no status
+		b.presenceLock.Lock()
+		defer b.presenceLock.Unlock()
+		if b.presence != "" {
+			if err := s.UpdateCustomStatus(b.presence); err != nil {
+				log.Printf("Failed to restore bot status: %v\n", err)
+			}
+		}
+	}
+}
+
+// discordgo reconnects on its own, these just keep track of it
+func (b *DiscordBot) handleDisconnect() func(*discordgo.Session, *discordgo.Disconnect) {
+	return func(s *discordgo.Session, d *discordgo.Disconnect) {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.connected = false
+	}
+}
+
+func (b *DiscordBot) handleResumed() func(*discordgo.Session, *discordgo.Resumed) {
+	return func(s *discordgo.Session, r *discordgo.Resumed) {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.connected = true
+	}
+}
+
+// Health is the health check for Discord: the gateway connection has to be
+// up so slash commands and buttons work
+func (b *DiscordBot) Health() (bool, any) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.connected, struct {
+		Connected bool   `json:"connected"`
+		User      string `json:"user,omitempty"`
+		GuildID   string `json:"guildId,omitempty"`
+		ChannelID string `json:"channelId"`
+	}{b.connected, b.botUser, b.GuildID, b.ChannelID}
+}
+
+// updatePresence keeps the bot's status showing the tank level as new
+// readings come in, without going over Discord's rate limits
+func (b *DiscordBot) updatePresence(ctx context.Context, session *discordgo.Session) {
+	updates, stop := b.Datastore.Watch()
+	defer stop()
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+
+	var latest string
+	var lastSent time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case data := <-updates:
+			latest = fmt.Sprintf("Tank: %.0f%% (%.0f lb)", data.Remaining, data.Weight)
+			if data.State != TankOK {
+				latest = fmt.Sprintf("Tank: %s (%.0f lb)", data.State.Describe(), data.Weight)
+			}
+			if time.Since(lastSent) < presenceInterval {
+				// The ticker will pick it up
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		b.presenceLock.Lock()
+		if latest != "" && latest != b.presence {
+			if err := session.UpdateCustomStatus(latest); err != nil {
+				log.Printf("Failed to update bot status: %v\n", err)
+			} else {
+				b.presence = latest
+				lastSent = time.Now()
+			}
+		}
+		b.presenceLock.Unlock()
 	}
 }
 
@@ -81,9 +408,284 @@ func (b *DiscordBot) handleWeight() func(*discordgo.Session, *discordgo.Interact
 		}
 		if err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 			Type: discordgo.InteractionResponseChannelMessageWithSource,
-			Data: &discordgo.InteractionResponseData{Content: b.Datastore.GetString()},
+			Data: &discordgo.InteractionResponseData{Content: describeTank(b.Datastore, b.History)},
+		}); err != nil {
+			fmt.Printf("Error: Failed to send response: %s", err)
+		}
+	}
+}
+
+func (b *DiscordBot) handleSubscribe() func(*discordgo.Session, *discordgo.InteractionCreate) {
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if i.Type != discordgo.InteractionApplicationCommand {
+			return
+		}
+		data := i.ApplicationCommandData()
+		if data.Name != "subscribe" {
+			return
+		}
+
+		var reply string
+		levels, err := optionLevels(data.Options)
+		if err != nil {
+			reply = err.Error()
+		} else if err := b.Subscriptions.Subscribe(interactionUser(i).ID, levels); err != nil {
+			log.Printf("Failed to save subscriptions: %s\n", err)
+			reply = "Hmm, I couldn't save your subscription. Try again later?"
+		} else {
+			reply = "Gotcha! I'll DM you about: " + joinLevels(b.Subscriptions.Levels(interactionUser(i).ID))
+		}
+		b.respondEphemeral(s, i, reply)
+	}
+}
+
+func (b *DiscordBot) handleUnsubscribe() func(*discordgo.Session, *discordgo.InteractionCreate) {
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if i.Type != discordgo.InteractionApplicationCommand {
+			return
+		}
+		data := i.ApplicationCommandData()
+		if data.Name != "unsubscribe" {
+			return
+		}
+
+		var reply string
+		levels, err := optionLevels(data.Options)
+		if err != nil {
+			reply = err.Error()
+		} else if err := b.Subscriptions.Unsubscribe(interactionUser(i).ID, levels); err != nil {
+			log.Printf("Failed to save subscriptions: %s\n", err)
+			reply = "Hmm, I couldn't update your subscription. Try again later?"
+		} else if remaining := b.Subscriptions.Levels(interactionUser(i).ID); len(remaining) > 0 {
+			reply = "Done. You're still subscribed to: " + joinLevels(remaining)
+		} else {
+			reply = "Done. I won't DM you about propane anymore."
+		}
+		b.respondEphemeral(s, i, reply)
+	}
+}
+
+func (b *DiscordBot) handleAck() func(*discordgo.Session, *discordgo.InteractionCreate) {
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if i.Type != discordgo.InteractionApplicationCommand {
+			return
+		}
+		data := i.ApplicationCommandData()
+		if data.Name != "ack" {
+			return
+		}
+
+		levels, err := optionLevels(data.Options)
+		if err != nil {
+			b.respondEphemeral(s, i, err.Error())
+			return
+		}
+
+		user := interactionUser(i)
+		var acked []AlertLevel
+		for _, l := range levels {
+			ok, err := b.Alerts.Ack(l, user.ID, user.Username, Now())
+			if err != nil {
+				log.Printf("Failed to save alerts: %s\n", err)
+			}
+			if ok {
+				acked = append(acked, l)
+				b.markOrdered(l, user, Now())
+			}
+		}
+		if len(acked) == 0 {
+			b.respondEphemeral(s, i, "There's nothing waiting to be acknowledged right now.")
+			return
+		}
+
+		if err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: fmt.Sprintf("Thanks <@%s>! Acknowledged: %s", user.ID, joinLevels(acked)),
+			},
 		}); err != nil {
 			fmt.Printf("Error: Failed to send response: %s", err)
 		}
 	}
 }
+
+func (b *DiscordBot) handleOrder() func(*discordgo.Session, *discordgo.InteractionCreate) {
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if i.Type != discordgo.InteractionApplicationCommand {
+			return
+		}
+		data := i.ApplicationCommandData()
+		if data.Name != "order" || len(data.Options) == 0 {
+			return
+		}
+		sub := data.Options[0]
+
+		if sub.Name == "status" {
+			reply := "There's no order in progress."
+			if o, ok := b.Orders.Current(); ok {
+				reply = o.Describe()
+			}
+			b.respondEphemeral(s, i, reply)
+			return
+		}
+
+		state := OrderCancelled
+		if sub.Name != "cancel" {
+			var err error
+			if state, err = ParseOrderState(sub.Name); err != nil {
+				b.respondEphemeral(s, i, err.Error())
+				return
+			}
+		}
+
+		var details OrderDetails
+		if state == OrderOrdered {
+			user := interactionUser(i)
+			details.OrderedBy = user.ID
+			details.OrderedByName = user.Username
+		}
+		for _, o := range sub.Options {
+			switch o.Name {
+			case "supplier":
+				details.Supplier = o.StringValue()
+			case "expected":
+				expected, err := ParseDate(o.StringValue())
+				if err != nil {
+					b.respondEphemeral(s, i, "The expected date needs to look like 2006-01-02")
+					return
+				}
+				details.ExpectedDelivery = expected
+			case "cost":
+				details.Cost = o.FloatValue()
+			}
+		}
+
+		order, err := b.Orders.Advance(state, Now(), details)
+		if err != nil {
+			b.respondEphemeral(s, i, "Can't do that: "+err.Error())
+			return
+		}
+		if err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: fmt.Sprintf("Got it, thanks <@%s>! %s.", interactionUser(i).ID, order.Describe()),
+			},
+		}); err != nil {
+			fmt.Printf("Error: Failed to send response: %s", err)
+		}
+	}
+}
+
+// markOrdered moves the current order along when somebody says they
+// ordered gas by acknowledging a low/critical/reorder alert
+func (b *DiscordBot) markOrdered(level AlertLevel, user *discordgo.User, now time.Time) {
+	if !level.NeedsOrder() {
+		return
+	}
+	if o, ok := b.Orders.Current(); ok && o.State != OrderNeeded {
+		return
+	}
+	if _, err := b.Orders.Advance(OrderOrdered, now, OrderDetails{OrderedBy: user.ID, OrderedByName: user.Username}); err != nil {
+		log.Printf("Failed to update order: %s\n", err)
+	}
+}
+
+// Handles the acknowledge button on alert messages
+func (b *DiscordBot) handleAckButton() func(*discordgo.Session, *discordgo.InteractionCreate) {
+	return func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if i.Type != discordgo.InteractionMessageComponent {
+			return
+		}
+		customID := i.MessageComponentData().CustomID
+		if !strings.HasPrefix(customID, ackButtonPrefix) {
+			return
+		}
+		level, err := ParseAlertLevel(strings.TrimPrefix(customID, ackButtonPrefix))
+		if err != nil {
+			b.respondEphemeral(s, i, err.Error())
+			return
+		}
+
+		user := interactionUser(i)
+		now := Now()
+		ok, err := b.Alerts.Ack(level, user.ID, user.Username, now)
+		if err != nil {
+			log.Printf("Failed to save alerts: %s\n", err)
+		}
+		if !ok {
+			b.respondEphemeral(s, i, "Looks like that alert has already been taken care of.")
+			return
+		}
+		b.markOrdered(level, user, now)
+
+		// Swap the button for a note saying who took care of it
+		content := fmt.Sprintf("%s\n✅ Acknowledged by <@%s> at %s", i.Message.Content, user.ID, FormatTime(now))
+		if err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseUpdateMessage,
+			Data: &discordgo.InteractionResponseData{
+				Content:    content,
+				Components: []discordgo.MessageComponent{},
+			},
+		}); err != nil {
+			fmt.Printf("Error: Failed to send response: %s", err)
+		}
+	}
+}
+
+// Replies to the interaction with a message only the caller can see
+func (b *DiscordBot) respondEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate, message string) {
+	if err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: message,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	}); err != nil {
+		fmt.Printf("Error: Failed to send response: %s", err)
+	}
+}
+
+// Interactions in a server carry a Member, ones in a DM carry a User
+func interactionUser(i *discordgo.InteractionCreate) *discordgo.User {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User
+	}
+	if i.User != nil {
+		return i.User
+	}
+	return &discordgo.User{}
+}
+
+// Turns the optional "level" option into the alert levels it stands for.
+// "all" or no option at all means every level.
+func optionLevels(options []*discordgo.ApplicationCommandInteractionDataOption) ([]AlertLevel, error) {
+	for _, o := range options {
+		if o.Name != "level" || o.StringValue() == "all" {
+			continue
+		}
+		l, err := ParseAlertLevel(o.StringValue())
+		if err != nil {
+			return nil, err
+		}
+		return []AlertLevel{l}, nil
+	}
+	return slices.Clone(alertLevels), nil
+}
+
+// Alert buttons have a custom ID of ackButtonPrefix followed by the level
+const ackButtonPrefix = "ack:"
+
+func ackLabel(level AlertLevel) string {
+	if level.NeedsOrder() {
+		return "I ordered it"
+	}
+	return "I'm on it"
+}
+
+func joinLevels(levels []AlertLevel) string {
+	names := make([]string, len(levels))
+	for i, l := range levels {
+		names[i] = string(l)
+	}
+	return strings.Join(names, ", ")
+}
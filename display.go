@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Times are kept in UTC everywhere (memory, the JSON files, MQTT) and only
+// turned into local time when they're shown to people, in the timezone and
+// format from the display section of config.json.
+
+const (
+	defaultTimezone   = "America/Chicago" // PS1 is located in Chicago
+	defaultTimeFormat = "Mon Jan _2 03:04PM 2006"
+)
+
+var (
+	displayLocation *time.Location
+	displayFormat   = defaultTimeFormat
+	displayMu       sync.RWMutex
+)
+
+// SetDisplayConfig changes the timezone and format times are shown in
+func SetDisplayConfig(cfg DisplayConfig) error {
+	location, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return err
+	}
+	displayMu.Lock()
+	defer displayMu.Unlock()
+	displayLocation = location
+	displayFormat = cfg.TimeFormat
+	if displayFormat == "" {
+		displayFormat = defaultTimeFormat
+	}
+	return nil
+}
+
+// LocalTime is t in the display timezone
+func LocalTime(t time.Time) time.Time {
+	displayMu.RLock()
+	defer displayMu.RUnlock()
+	if displayLocation == nil {
+		return t
+	}
+	return t.In(displayLocation)
+}
+
+// FormatTime shows t in the display timezone and format
+func FormatTime(t time.Time) string {
+	displayMu.RLock()
+	format := displayFormat
+	displayMu.RUnlock()
+	return LocalTime(t).Format(format)
+}
+
+// ParseDate reads a date like 2006-01-02 that somebody typed in, as
+// midnight in the display timezone (which is where they are)
+func ParseDate(s string) (time.Time, error) {
+	displayMu.RLock()
+	location := displayLocation
+	displayMu.RUnlock()
+	if location == nil {
+		location = time.UTC
+	}
+	return time.ParseInLocation("2006-01-02", s, location)
+}
+
+// FormatTimeAgo is FormatTime with how long ago it was tacked on, e.g.
+// "Mon Jan  5 03:04PM 2026 (3 minutes ago)"
+func FormatTimeAgo(t, now time.Time) string {
+	return fmt.Sprintf("%s (%s)", FormatTime(t), TimeAgo(t, now))
+}
+
+// TimeAgo says how long ago t was in words, like "3 minutes ago" or
+// "in 2 days"
+func TimeAgo(t, now time.Time) string {
+	d := now.Sub(t)
+	if d.Abs() < time.Minute {
+		return "just now"
+	}
+
+	var n float64
+	var unit string
+	switch a := d.Abs(); {
+	case a < time.Hour:
+		n, unit = a.Minutes(), "minute"
+	case a < 24*time.Hour:
+		n, unit = a.Hours(), "hour"
+	default:
+		n, unit = a.Hours()/24, "day"
+	}
+	count := int(math.Floor(n))
+	if count != 1 {
+		unit += "s"
+	}
+	if d < 0 {
+		return fmt.Sprintf("in %d %s", count, unit)
+	}
+	return fmt.Sprintf("%d %s ago", count, unit)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Helpers for the JSON files we keep state and settings in.
+
+// How long a file we're watching has to stay unchanged before we reload it
+const fileSettleTime = 500 * time.Millisecond
+
+// writeFileAtomic writes data to a temp file next to path and renames it
+// over path, so a crash (or the power going out) mid-write leaves either
+// the old file or the new one, never half of each. Anything watching the
+// file never sees it half-written either.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := os.CreateTemp(dir, "."+name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	// Only does anything if we bail out before the rename
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		if errors.Is(err, syscall.EBUSY) {
+			// It's a file bind-mounted into a container on its own, which
+			// can't be replaced, only written to
+			return os.WriteFile(path, data, perm)
+		}
+		return err
+	}
+
+	// Make sure the rename itself makes it to disk
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// watchFile calls changed whenever the file at path is written, replaced,
+// created or removed, once things have been quiet for settle. Saving a
+// file often shows up as several events (truncate, write, chmod...), and
+// this turns them into one call.
+//
+// It watches the directory as well as the file, so it keeps working when
+// the file is replaced by a rename (like writeFileAtomic and a lot of
+// editors do) and even if the file doesn't exist yet. Watching the file
+// itself catches edits to a file bind-mounted into a container, which the
+// directory doesn't hear about.
+func watchFile(ctx context.Context, path string, settle time.Duration, changed func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	path = filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return err
+	}
+	_ = watcher.Add(path)
+
+	timer := time.NewTimer(settle)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			changed()
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) == path && event.Op&^fsnotify.Chmod != 0 {
+				// A new file (or one renamed over the old one) needs
+				// watching again
+				if event.Has(fsnotify.Create) {
+					_ = watcher.Add(path)
+				}
+				timer.Reset(settle)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			log.Printf("%s watcher error: %v", path, err)
+		}
+	}
+}
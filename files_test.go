@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	for _, contents := range []string{`{"first": true}`, `{"second": true}`} {
+		if err := writeFileAtomic(path, []byte(contents), 0600); err != nil {
+			t.Fatalf("writeFileAtomic() error = %v", err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != contents {
+			t.Errorf("the file has %q, want %q", got, contents)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("the file's permissions are %v, want 0600", info.Mode().Perm())
+	}
+	// No temp files left lying around
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("the directory has %d files in it, want just the one", len(entries))
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "settings.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var calls atomic.Int32
+	go watchFile(ctx, path, 100*time.Millisecond, func() { calls.Add(1) })
+	// Give the watcher a moment to start
+	time.Sleep(50 * time.Millisecond)
+	settled := func() int32 {
+		time.Sleep(300 * time.Millisecond)
+		return calls.Swap(0)
+	}
+
+	// A burst of writes is one change, and it works for a file that didn't
+	// exist when we started watching
+	for i := range 5 {
+		if err := os.WriteFile(path, []byte{byte('0' + i)}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := settled(); got != 1 {
+		t.Errorf("a burst of writes made %d calls, want 1", got)
+	}
+
+	// Replacing the file by renaming another one over it counts too, and
+	// the watch carries on working after that
+	if err := writeFileAtomic(path, []byte("replaced"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := settled(); got != 1 {
+		t.Errorf("replacing the file made %d calls, want 1", got)
+	}
+	if err := os.WriteFile(path, []byte("again"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := settled(); got != 1 {
+		t.Errorf("writing the file after it was replaced made %d calls, want 1", got)
+	}
+
+	// Other files in the same directory don't
+	if err := os.WriteFile(filepath.Join(dir, "other.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := settled(); got != 0 {
+		t.Errorf("writing another file made %d calls, want none", got)
+	}
+}
+
+// A config file that shows up after the bot started is picked up
+func TestWatchConfigCreated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	current := DefaultConfig()
+	applied := make(chan AppConfig, 1)
+	go WatchConfig(ctx, path, current, nil, func(old, new AppConfig) { applied <- new })()
+	time.Sleep(50 * time.Millisecond)
+
+	config := `{"mqtt": {"enabled": false}, "discord": {"enabled": false}, "monitor": {"interval": "2h"}}`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case cfg := <-applied:
+		if cfg.Monitor.Interval.Duration != 2*time.Hour {
+			t.Errorf("monitor.interval = %s, want 2h", cfg.Monitor.Interval.Duration)
+		}
+	case <-time.After(fileSettleTime + time.Second):
+		t.Fatal("the new config file wasn't picked up")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keeps a thinned-out history of readings so we can work out how fast
+// we've been burning through the cylinder, and from that how many days
+// it has left. Kept in history.json so a restart doesn't have to start
+// learning from scratch.
+
+const historyFile = "history.json"
+
+const (
+	// Only keep one reading per sampleEvery...
+	sampleEvery = 15 * time.Minute
+	// ...for this long
+	historyWindow = 14 * 24 * time.Hour
+	// Don't guess until we've got at least this much to go on
+	minForecastSpan = 24 * time.Hour
+)
+
+type Forecast struct {
+	// How fast the gas has been going since the cylinder went on
+	LbsPerDay float64
+	// How long until it's empty at that rate
+	DaysRemaining float64
+}
+
+// Describe gives a sentence about the forecast for the bot and web page
+func (f Forecast) Describe() string {
+	return fmt.Sprintf("At the rate we've been going (%.1f lbs/day) that's about %.0f days left.", f.LbsPerDay, f.DaysRemaining)
+}
+
+type ConsumptionHistory struct {
+	path      string
+	datastore ReadingSource
+	cylinder  CylinderSettings
+	samples   []CurrentData
+	lock      sync.RWMutex
+}
+
+// NewConsumptionHistory loads the history kept at path. Run keeps it up
+// to date with the readings going into ds, cyl is the cylinder they're
+// from.
+func NewConsumptionHistory(path string, ds ReadingSource, cyl CylinderSettings) *ConsumptionHistory {
+	h := &ConsumptionHistory{path: path, datastore: ds, cylinder: cyl}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to read history: %s\n", err)
+		}
+		return h
+	}
+	if err := json.Unmarshal(data, &h.samples); err != nil {
+		log.Printf("Failed to parse history: %s\n", err)
+	}
+	return h
+}
+
+// Run records readings from the datastore as they come in
+func (h *ConsumptionHistory) Run(ctx context.Context) func() error {
+	return func() error {
+		updates, stop := h.datastore.Watch()
+		defer stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case data := <-updates:
+				if err := h.Add(data); err != nil {
+					log.Printf("Failed to save history: %v\n", err)
+				}
+			}
+		}
+	}
+}
+
+// Add records a reading, if it's been long enough since the last one.
+// Readings with no cylinder on the scale say nothing about how fast we're
+// using gas, so they're left out.
+func (h *ConsumptionHistory) Add(data CurrentData) error {
+	if data.State == TankNoCylinder {
+		return nil
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if n := len(h.samples); n > 0 {
+		last := h.samples[n-1]
+		// A new cylinder gets recorded right away so we start over from
+		// it, since anything older is from the last one
+		refilled := Refilled(last.Weight, data.Weight)
+		if !refilled && data.TimeStamp.Sub(last.TimeStamp) < sampleEvery {
+			return nil
+		}
+		if refilled {
+			h.samples = nil
+		}
+	}
+
+	h.samples = append(h.samples, data)
+	for len(h.samples) > 0 && data.TimeStamp.Sub(h.samples[0].TimeStamp) > historyWindow {
+		h.samples = h.samples[1:]
+	}
+	return h.save()
+}
+
+// Forecast works out the burn rate from the history using a least
+// squares fit of weight over time. It returns false if there isn't enough
+// history yet, or we haven't been using any gas.
+func (h *ConsumptionHistory) Forecast() (Forecast, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	n := len(h.samples)
+	if n < 3 || h.samples[n-1].TimeStamp.Sub(h.samples[0].TimeStamp) < minForecastSpan {
+		return Forecast{}, false
+	}
+
+	// x is days since the first sample, y is the weight
+	start := h.samples[0].TimeStamp
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range h.samples {
+		x := s.TimeStamp.Sub(start).Hours() / 24
+		sumX += x
+		sumY += s.Weight
+		sumXY += x * s.Weight
+		sumXX += x * x
+	}
+	count := float64(n)
+	denom := count*sumXX - sumX*sumX
+	if denom == 0 {
+		return Forecast{}, false
+	}
+	slope := (count*sumXY - sumX*sumY) / denom
+	if slope >= 0 {
+		return Forecast{}, false
+	}
+
+	// The gas left is however much the latest weight is over where
+	// CalcRemaining says 0% (the tare, less the extra weight), up to a
+	// full cylinder. It's worked out from the latest cylinder settings
+	// rather than the ones the sample was taken with, since they might
+	// have changed since.
+	cyl := h.cylinder.Get()
+	gasLeft := h.samples[n-1].Weight - (cyl.TareWeight - cyl.ExtraWeight)
+	gasLeft = min(max(gasLeft, 0), cyl.FullWeight-cyl.TareWeight+cyl.ExtraWeight)
+
+	return Forecast{
+		LbsPerDay:     -slope,
+		DaysRemaining: gasLeft / -slope,
+	}, true
+}
+
+// Describe gives a sentence about the forecast, or nothing if we can't
+// make one yet
+func (h *ConsumptionHistory) Describe() string {
+	if f, ok := h.Forecast(); ok {
+		return f.Describe()
+	}
+	return ""
+}
+
+// describeTank is what /weight in Discord and the web page say about the
+// tank: the latest reading, and the forecast once there is one
+func describeTank(ds ReadingSource, h *ConsumptionHistory) string {
+	return strings.TrimSpace(ds.GetString() + " " + h.Describe())
+}
+
+// Must be called with the lock held
+func (h *ConsumptionHistory) save() error {
+	data, err := json.Marshal(h.samples)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(h.path, data, 0644)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestForecast(t *testing.T) {
+	tests := []struct {
+		name     string
+		cylinder Cylinder
+		// Where the weight ends up after three days of burning 2 lbs/day
+		last     float64
+		wantDays float64
+	}{
+		{"no extra weight", Cylinder{TareWeight: 60, FullWeight: 160}, 100, 20},
+		// The empty cylinder weighs less than its tare, so there's more
+		// gas left than the tare says
+		{"extra weight", Cylinder{TareWeight: 60, FullWeight: 160, ExtraWeight: 10}, 100, 25},
+		{"below empty", Cylinder{TareWeight: 60, FullWeight: 160, ExtraWeight: 10}, 45, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cyl := NewCylinderStore(filepath.Join(t.TempDir(), cylinderFile))
+			if err := cyl.Save(tt.cylinder); err != nil {
+				t.Fatal(err)
+			}
+			h := NewConsumptionHistory(filepath.Join(t.TempDir(), historyFile), NewDatastore(cyl), cyl)
+			if _, ok := h.Forecast(); ok {
+				t.Fatalf("there shouldn't be a forecast without any history")
+			}
+
+			for day := range 4 {
+				weight := tt.last + float64(2*(3-day))
+				data := CurrentData{Weight: weight, TimeStamp: monitorStart.Add(time.Duration(day) * 24 * time.Hour), State: TankOK}
+				if err := h.Add(data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f, ok := h.Forecast()
+			if !ok {
+				t.Fatalf("there should be a forecast after three days")
+			}
+			if math.Abs(f.LbsPerDay-2) > 1e-9 || math.Abs(f.DaysRemaining-tt.wantDays) > 1e-9 {
+				t.Errorf("Forecast() = %+v, want 2 lbs/day and %g days left", f, tt.wantDays)
+			}
+		})
+	}
+}
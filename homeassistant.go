@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Announces the propane tank to Home Assistant using MQTT discovery, so it
+// shows up as a device with sensors for the weight, percent remaining,
+// days left, when the last reading came in and whether there's a cylinder
+// on the scale that weighs what it should, plus binary sensors for low gas
+// and a possible leak. The sensors read the state StatePublisher
+// publishes, so mqtt.publishTopic has to be set.
+
+// MQTTPubSub is somewhere to publish to and listen on (that's
+// MQTTListener)
+type MQTTPubSub interface {
+	MQTTPublisher
+	Subscribe(topic string, handler func(payload []byte)) error
+	Unsubscribe(topic string) error
+}
+
+type HomeAssistant struct {
+	MQTT    MQTTPubSub
+	Enabled bool
+	// Where Home Assistant looks for discovery configs, usually
+	// "homeassistant"
+	DiscoveryPrefix string
+	// Identifies the device (and its sensors) in Home Assistant
+	NodeID string
+	// Where StatePublisher publishes, and whether we're online
+	StateTopic        string
+	AvailabilityTopic string
+	// Guards the settings above, which can change when config.json does
+	lock sync.Mutex
+}
+
+// Reconfigure applies new settings from config.json and announces
+// everything again. If the tank has moved (a new discovery prefix or node
+// ID) or Home Assistant has been turned off, the old configs are removed
+// so Home Assistant doesn't keep a second tank that never updates.
+func (h *HomeAssistant) Reconfigure(cfg HomeAssistantConfig, mqtt MQTTConfig) {
+	h.lock.Lock()
+	wasEnabled, oldPrefix, oldNodeID := h.Enabled, h.DiscoveryPrefix, h.NodeID
+	h.Enabled = cfg.Enabled
+	h.DiscoveryPrefix = cfg.DiscoveryPrefix
+	h.NodeID = cfg.NodeID
+	h.StateTopic = mqtt.StateTopic()
+	h.AvailabilityTopic = mqtt.AvailabilityTopic()
+	h.lock.Unlock()
+
+	newPrefix := cfg.DiscoveryPrefix != oldPrefix
+	if wasEnabled && (!cfg.Enabled || newPrefix || cfg.NodeID != oldNodeID) {
+		h.forget(oldPrefix, oldNodeID)
+	}
+	if wasEnabled && (!cfg.Enabled || newPrefix) {
+		status := oldPrefix + "/status"
+		if err := h.MQTT.Unsubscribe(status); err != nil && !errors.Is(err, errNotConnected) {
+			log.Printf("Failed to unsubscribe from %s: %v\n", status, err)
+		}
+	}
+	if cfg.Enabled && (!wasEnabled || newPrefix) {
+		h.listen()
+	}
+	h.Announce()
+}
+
+// OnConnect announces everything, and listens for Home Assistant coming
+// back online so we can announce again in case its broker lost the
+// retained configs
+func (h *HomeAssistant) OnConnect() {
+	h.lock.Lock()
+	enabled := h.Enabled
+	h.lock.Unlock()
+	if !enabled {
+		return
+	}
+	h.listen()
+	h.Announce()
+}
+
+// listen listens for Home Assistant coming online
+func (h *HomeAssistant) listen() {
+	h.lock.Lock()
+	status := h.DiscoveryPrefix + "/status"
+	h.lock.Unlock()
+
+	if err := h.MQTT.Subscribe(status, func(payload []byte) {
+		if string(payload) == "online" {
+			log.Println("Home Assistant came online, announcing the propane tank")
+			go h.Announce()
+		}
+	}); err != nil && !errors.Is(err, errNotConnected) {
+		log.Printf("Failed to subscribe to %s: %v\n", status, err)
+	}
+}
+
+// forget removes the discovery configs published under prefix and nodeID,
+// which takes the sensors out of Home Assistant
+func (h *HomeAssistant) forget(prefix, nodeID string) {
+	for _, e := range haEntities("") {
+		topic := e.topic(prefix, nodeID)
+		if err := h.MQTT.Publish(topic, true, nil); err != nil {
+			if errors.Is(err, errNotConnected) {
+				log.Printf("Not connected to the broker, so the old Home Assistant configs under %s/.../%s are still there\n", prefix, nodeID)
+				return
+			}
+			log.Printf("Failed to clear %s: %v\n", topic, err)
+		}
+	}
+}
+
+type haEntity struct {
+	component string
+	id        string
+	config    map[string]any
+}
+
+// topic is where the entity's discovery config goes
+func (e haEntity) topic(prefix, nodeID string) string {
+	return fmt.Sprintf("%s/%s/%s/%s/config", prefix, e.component, nodeID, e.id)
+}
+
+// Announce publishes the discovery config for each sensor
+func (h *HomeAssistant) Announce() {
+	h.lock.Lock()
+	enabled, prefix, nodeID := h.Enabled, h.DiscoveryPrefix, h.NodeID
+	state, availability := h.StateTopic, h.AvailabilityTopic
+	h.lock.Unlock()
+	if !enabled {
+		return
+	}
+
+	device := map[string]any{
+		"identifiers":  []string{nodeID},
+		"name":         "Propane Tank",
+		"manufacturer": "Pumping Station: One",
+		"model":        "PropaneBot",
+	}
+	for _, e := range haEntities(state) {
+		e.config["unique_id"] = nodeID + "_" + e.id
+		e.config["object_id"] = nodeID + "_" + e.id
+		e.config["device"] = device
+		e.config["availability_topic"] = availability
+
+		topic := e.topic(prefix, nodeID)
+		payload, err := json.Marshal(e.config)
+		if err != nil {
+			log.Printf("Failed to encode %s: %v\n", topic, err)
+			continue
+		}
+		if err := h.MQTT.Publish(topic, true, payload); err != nil {
+			if errors.Is(err, errNotConnected) {
+				// We'll announce again once we are
+				return
+			}
+			log.Printf("Failed to publish %s: %v\n", topic, err)
+		}
+	}
+}
+
+// haEntities are the sensors, reading from the state topic
+func haEntities(state string) []haEntity {
+	return []haEntity{
+		{"sensor", "weight", map[string]any{
+			"name":                "Weight",
+			"state_topic":         state + "/remaining",
+			"value_template":      "{{ value_json.weight }}",
+			"unit_of_measurement": "lb",
+			"device_class":        "weight",
+			"state_class":         "measurement",
+		}},
+		{"sensor", "remaining", map[string]any{
+			"name":                "Remaining",
+			"state_topic":         state + "/remaining",
+			"value_template":      "{{ value_json.remaining if value_json.remaining is not none else None }}",
+			"unit_of_measurement": "%",
+			"state_class":         "measurement",
+			"icon":                "mdi:propane-tank",
+		}},
+		{"sensor", "days_remaining", map[string]any{
+			"name":                "Days remaining",
+			"state_topic":         state + "/forecast",
+			"value_template":      "{{ value_json.daysRemaining | round(0) if value_json.daysRemaining is not none else None }}",
+			"unit_of_measurement": "d",
+			"device_class":        "duration",
+		}},
+		{"sensor", "last_reading", map[string]any{
+			"name":           "Last reading",
+			"state_topic":    state + "/remaining",
+			"value_template": "{{ value_json.timestamp }}",
+			"device_class":   "timestamp",
+		}},
+		{"binary_sensor", "low", map[string]any{
+			"name":           "Low gas",
+			"state_topic":    state + "/alerts",
+			"value_template": "{{ 'ON' if 'low' in value_json.active or 'critical' in value_json.active else 'OFF' }}",
+			"device_class":   "problem",
+		}},
+		{"sensor", "cylinder", map[string]any{
+			"name":           "Cylinder",
+			"state_topic":    state + "/remaining",
+			"value_template": "{{ value_json.state }}",
+			"device_class":   "enum",
+			"options":        []TankState{TankOK, TankNoCylinder, TankOverFull, TankBelowTare},
+			"icon":           "mdi:scale",
+		}},
+		{"binary_sensor", "leak", map[string]any{
+			"name":           "Leak",
+			"state_topic":    state + "/alerts",
+			"value_template": "{{ 'ON' if 'leak' in value_json.active else 'OFF' }}",
+			"device_class":   "gas",
+		}},
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// checkDiscovery checks there's a config for every sensor under prefix and
+// nodeID, or that they've all been removed
+func checkDiscovery(t *testing.T, mqtt *fakeMQTT, prefix, nodeID string, announced bool) {
+	t.Helper()
+	for _, e := range haEntities("") {
+		topic := fmt.Sprintf("%s/%s/%s/%s/config", prefix, e.component, nodeID, e.id)
+		payload, ok := mqtt.last(topic)
+		if !announced {
+			if ok && len(payload) > 0 {
+				t.Errorf("%s is still %s, want it removed", topic, payload)
+			}
+			continue
+		}
+		var config struct {
+			UniqueID string `json:"unique_id"`
+		}
+		if err := json.Unmarshal(payload, &config); err != nil {
+			t.Errorf("%s = %q, want a config: %v", topic, payload, err)
+			continue
+		}
+		if config.UniqueID != nodeID+"_"+e.id {
+			t.Errorf("%s has unique_id %q, want %q", topic, config.UniqueID, nodeID+"_"+e.id)
+		}
+	}
+}
+
+func TestHomeAssistantDiscovery(t *testing.T) {
+	mqtt := &fakeMQTT{}
+	publish := MQTTConfig{PublishTopic: "propane/state"}
+	ha := &HomeAssistant{
+		MQTT:              mqtt,
+		Enabled:           true,
+		DiscoveryPrefix:   "homeassistant",
+		NodeID:            "propanebot",
+		StateTopic:        publish.StateTopic(),
+		AvailabilityTopic: publish.AvailabilityTopic(),
+	}
+	ha.OnConnect()
+	checkDiscovery(t, mqtt, "homeassistant", "propanebot", true)
+	if got := mqtt.subscribed(); !slices.Equal(got, []string{"homeassistant/status"}) {
+		t.Errorf("subscribed to %q, want homeassistant/status", got)
+	}
+
+	// A new node ID takes the old sensors away
+	ha.Reconfigure(HomeAssistantConfig{Enabled: true, DiscoveryPrefix: "homeassistant", NodeID: "tank2"}, publish)
+	checkDiscovery(t, mqtt, "homeassistant", "propanebot", false)
+	checkDiscovery(t, mqtt, "homeassistant", "tank2", true)
+	if got := mqtt.subscribed(); !slices.Equal(got, []string{"homeassistant/status"}) {
+		t.Errorf("subscribed to %q, want homeassistant/status", got)
+	}
+
+	// So does a new prefix, and it's listened on instead
+	ha.Reconfigure(HomeAssistantConfig{Enabled: true, DiscoveryPrefix: "ha", NodeID: "tank2"}, publish)
+	checkDiscovery(t, mqtt, "homeassistant", "tank2", false)
+	checkDiscovery(t, mqtt, "ha", "tank2", true)
+	if got := mqtt.subscribed(); !slices.Equal(got, []string{"ha/status"}) {
+		t.Errorf("subscribed to %q, want just ha/status", got)
+	}
+
+	// Turning it off takes everything away, and reconnecting doesn't bring
+	// it back
+	ha.Reconfigure(HomeAssistantConfig{Enabled: false, DiscoveryPrefix: "ha", NodeID: "tank2"}, publish)
+	ha.OnConnect()
+	checkDiscovery(t, mqtt, "ha", "tank2", false)
+	if got := mqtt.subscribed(); len(got) != 0 {
+		t.Errorf("subscribed to %q, want nothing", got)
+	}
+
+	// Until it's turned back on
+	ha.Reconfigure(HomeAssistantConfig{Enabled: true, DiscoveryPrefix: "ha", NodeID: "tank2"}, publish)
+	checkDiscovery(t, mqtt, "ha", "tank2", true)
+	if got := mqtt.subscribed(); !slices.Equal(got, []string{"ha/status"}) {
+		t.Errorf("subscribed to %q, want ha/status", got)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every way a reading can get to us (MQTT, POST /api/readings...) goes
+// through Ingester, so they all understand the same payloads and get the
+// same checks before anything lands in the Datastore.
+//
+// A payload is either what the scale has always sent over MQTT:
+//
+//	1577640142,163.4
+//
+// (unix timestamp, then the weight in lbs) or JSON:
+//
+//	{"timestamp": 1577640142, "weight": 163.4}
+//
+// where the timestamp is optional and defaults to now.
+
+const (
+	// Nothing we'd put on the scale weighs more than this, so it's junk
+	maxWeight = 1000
+	// Allow for the scale's clock being a bit ahead of ours
+	maxClockSkew = 5 * time.Minute
+)
+
+type Reading struct {
+	Weight    float64
+	TimeStamp time.Time
+}
+
+type Ingester struct {
+	Datastore *Datastore
+	// Corrects the scale's readings, nil if there's nothing to correct
+	Calibration *CalibrationStore
+	// What time it is, for checking timestamps, nil for the bot's clock
+	Clock Clock
+	// Serializes readings from different transports so the out-of-order
+	// check is reliable
+	lock sync.Mutex
+	// The latest reading as the scale sent it, for calibrating
+	raw Reading
+}
+
+// Accept parses and checks the payload, and stores the reading if it's
+// good. Bad ones are logged, source says where they came from.
+func (in *Ingester) Accept(source string, payload []byte) (Reading, error) {
+	reading, err := ParseReading(payload, nowFrom(in.Clock))
+	if err == nil {
+		err = in.Store(reading)
+	}
+	if err != nil {
+		log.Printf("Ignoring reading %q from %s: %v\n", payload, source, err)
+		return Reading{}, err
+	}
+	return reading, nil
+}
+
+// Store checks the reading makes sense, corrects it with the latest
+// calibration and puts it in the Datastore
+func (in *Ingester) Store(reading Reading) error {
+	now := nowFrom(in.Clock)
+	if math.IsNaN(reading.Weight) || math.IsInf(reading.Weight, 0) || reading.Weight < 0 || reading.Weight > maxWeight {
+		return fmt.Errorf("a weight of %v lbs doesn't make sense", reading.Weight)
+	}
+	if reading.TimeStamp.After(now.Add(maxClockSkew)) {
+		return fmt.Errorf("the timestamp %s is in the future", reading.TimeStamp.Format(time.RFC3339))
+	}
+
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	// Something held on to by the broker, or a slow HTTP client, shouldn't
+	// replace a newer reading
+	if latest := in.Datastore.Get(); reading.TimeStamp.Before(latest.TimeStamp) {
+		return fmt.Errorf("the reading from %s is older than the one we already have", reading.TimeStamp.Format(time.RFC3339))
+	}
+
+	in.raw = reading
+	in.Datastore.Set(in.correct(reading.Weight), reading.TimeStamp)
+	return nil
+}
+
+// Recalibrate corrects the latest reading again, so a new calibration
+// shows up straight away rather than with the next reading
+func (in *Ingester) Recalibrate() {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	if in.raw.TimeStamp.IsZero() {
+		return
+	}
+	in.Datastore.Set(in.correct(in.raw.Weight), in.raw.TimeStamp)
+}
+
+// correct applies the latest calibration to a raw weight
+func (in *Ingester) correct(raw float64) float64 {
+	if in.Calibration == nil {
+		return raw
+	}
+	// An empty scale can't weigh less than nothing, however far off it is
+	return max(in.Calibration.Apply(raw), 0)
+}
+
+// LatestRaw returns the latest reading as the scale sent it, before it was
+// corrected, if there's been one
+func (in *Ingester) LatestRaw() (Reading, bool) {
+	in.lock.Lock()
+	defer in.lock.Unlock()
+	return in.raw, !in.raw.TimeStamp.IsZero()
+}
+
+// ParseReading understands either payload format. now is used when the
+// payload doesn't say when the reading was taken.
+func ParseReading(payload []byte, now time.Time) (Reading, error) {
+	text := strings.TrimSpace(string(payload))
+	if strings.HasPrefix(text, "{") {
+		return parseJSONReading([]byte(text), now)
+	}
+
+	timestamp, weight, ok := strings.Cut(text, ",")
+	if !ok {
+		return Reading{}, errors.New(`expected "timestamp,weight" or JSON`)
+	}
+	ts, err := strconv.ParseInt(strings.TrimSpace(timestamp), 10, 64)
+	if err != nil {
+		return Reading{}, fmt.Errorf("bad timestamp %q", timestamp)
+	}
+	w, err := strconv.ParseFloat(strings.TrimSpace(weight), 64)
+	if err != nil {
+		return Reading{}, fmt.Errorf("bad weight %q", weight)
+	}
+	return Reading{Weight: w, TimeStamp: time.Unix(ts, 0).UTC()}, nil
+}
+
+func parseJSONReading(payload []byte, now time.Time) (Reading, error) {
+	var body struct {
+		Weight    *float64 `json:"weight"`
+		TimeStamp *int64   `json:"timestamp"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return Reading{}, err
+	}
+	if body.Weight == nil {
+		return Reading{}, errors.New("weight is missing")
+	}
+	reading := Reading{Weight: *body.Weight, TimeStamp: now}
+	if body.TimeStamp != nil {
+		reading.TimeStamp = time.Unix(*body.TimeStamp, 0).UTC()
+	}
+	return reading, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestIngester(t *testing.T) (*Ingester, *Datastore) {
+	ds := NewDatastore(newTestCylinderStore(t))
+	return &Ingester{Datastore: ds}, ds
+}
+
+func TestParseReading(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name    string
+		payload string
+		want    Reading
+		wantErr string
+	}{
+		{"csv", "1577640142,163.4", Reading{163.4, time.Unix(1577640142, 0).UTC()}, ""},
+		{"csv with spaces", " 1577640142 , 163.4\n", Reading{163.4, time.Unix(1577640142, 0).UTC()}, ""},
+		{"json", `{"timestamp": 1577640142, "weight": 163.4}`, Reading{163.4, time.Unix(1577640142, 0).UTC()}, ""},
+		{"json without a timestamp", `{"weight": 99}`, Reading{99, now}, ""},
+		{"json without a weight", `{"timestamp": 1577640142}`, Reading{}, "weight is missing"},
+		{"bad json", `{"weight": }`, Reading{}, "invalid character"},
+		{"just a number", "163.4", Reading{}, "expected"},
+		{"bad timestamp", "yesterday,163.4", Reading{}, "bad timestamp"},
+		{"bad weight", "1577640142,lots", Reading{}, "bad weight"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseReading([]byte(tt.payload), now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseReading(%q) error = %v, want one containing %q", tt.payload, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseReading(%q) error = %v", tt.payload, err)
+			}
+			if got.Weight != tt.want.Weight || !got.TimeStamp.Equal(tt.want.TimeStamp) {
+				t.Errorf("ParseReading(%q) = %+v, want %+v", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIngesterStore(t *testing.T) {
+	in, ds := newTestIngester(t)
+	now := Now()
+
+	if err := in.Store(Reading{Weight: 110, TimeStamp: now}); err != nil {
+		t.Fatalf("Store() error = %v", err)
+	}
+	if got := ds.Get(); got.Weight != 110 || got.Remaining != 50 || !got.TimeStamp.Equal(now) {
+		t.Errorf("after Store() the datastore has %+v, want 110 lbs at 50%%", got)
+	}
+
+	bad := []struct {
+		name    string
+		reading Reading
+	}{
+		{"negative", Reading{-1, now}},
+		{"too heavy", Reading{maxWeight + 1, now}},
+		{"NaN", Reading{math.NaN(), now}},
+		{"infinite", Reading{math.Inf(1), now}},
+		{"from the future", Reading{100, now.Add(time.Hour)}},
+		{"older than the last one", Reading{100, now.Add(-time.Minute)}},
+	}
+	for _, tt := range bad {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := in.Store(tt.reading); err == nil {
+				t.Errorf("Store(%+v) should have been rejected", tt.reading)
+			}
+			if got := ds.Get(); got.Weight != 110 {
+				t.Errorf("a rejected reading changed the datastore to %+v", got)
+			}
+		})
+	}
+}
+
+func TestIngesterCalibration(t *testing.T) {
+	in, ds := newTestIngester(t)
+	in.Calibration = NewCalibrationStore(filepath.Join(t.TempDir(), calibrationFile))
+	now := Now()
+
+	// Nothing to correct yet
+	if err := in.Store(Reading{112, now.Add(-3 * time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ds.Get().Weight; got != 112 {
+		t.Errorf("an uncalibrated reading was changed to %v", got)
+	}
+
+	// The scale reads 2 lbs high
+	if err := in.Calibration.AddPoint(CalibrationPoint{Reference: 45, Raw: 47, At: now}); err != nil {
+		t.Fatal(err)
+	}
+	in.Calibration.OnChange(in.Recalibrate)
+	if _, err := in.Calibration.Finish(now, ""); err != nil {
+		t.Fatal(err)
+	}
+	// The reading we already have is corrected straight away
+	if got := ds.Get(); got.Weight != 110 || !got.TimeStamp.Equal(now.Add(-3*time.Minute)) {
+		t.Errorf("the datastore has %+v, want the last reading corrected to 110 lbs", got)
+	}
+	if err := in.Store(Reading{112, now.Add(-2 * time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ds.Get(); got.Weight != 110 || got.Remaining != 50 {
+		t.Errorf("the datastore has %+v, want the corrected 110 lbs at 50%%", got)
+	}
+	if raw, ok := in.LatestRaw(); !ok || raw.Weight != 112 {
+		t.Errorf("LatestRaw() = %+v, want what the scale said", raw)
+	}
+
+	// And an empty scale doesn't weigh less than nothing
+	if err := in.Store(Reading{1, now.Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if got := ds.Get().Weight; got != 0 {
+		t.Errorf("the empty scale weighs %v, want 0", got)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// waitFor polls cond until it's true, failing the test if that takes too
+// long
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A reading published by the scale goes through the built-in broker, the
+// MQTT listener and the Ingester into the Datastore, and the monitor sends
+// an alert about it
+func TestReadingToAlert(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := &Broker{BrokerConfig: BrokerConfig{Enabled: true, Address: "127.0.0.1:0"}}
+	go broker.Run(ctx)()
+	waitFor(t, "the broker to start", func() bool { return broker.Addr() != "" })
+	server := "tcp://" + broker.Addr()
+
+	m := newTestMonitor(t)
+	ingest := &Ingester{Datastore: m.ds}
+	listener := &MQTTListener{
+		Ingest: ingest,
+		MQTTConfig: MQTTConfig{
+			Enabled:      true,
+			Server:       server,
+			Topic:        "propane/weight",
+			ClientID:     "propanebot-test",
+			QoS:          1,
+			CleanSession: true,
+		},
+	}
+	go listener.Run(ctx)()
+	waitFor(t, "the listener to subscribe", func() bool {
+		ready, _ := listener.Health()
+		return ready
+	})
+
+	m.SetInterval(20 * time.Millisecond)
+	m.WatchBroker(listener)
+	go m.Start(ctx)
+
+	// Down to 15%
+	scale := MQTT.NewClient(MQTT.NewClientOptions().AddBroker(server).SetClientID("scale"))
+	if token := scale.Connect(); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+	defer scale.Disconnect(0)
+	payload := fmt.Sprintf("%d,75.0", time.Now().Unix())
+	if token := scale.Publish("propane/weight", 1, false, payload); token.Wait() && token.Error() != nil {
+		t.Fatal(token.Error())
+	}
+
+	waitFor(t, "the low alert", func() bool { return len(m.notifier.sent()) > 0 })
+	got := m.notifier.sent()[0]
+	if got.Level != AlertLow {
+		t.Errorf("got a %s alert, want low", got.Level)
+	}
+	if data := m.ds.Get(); data.Weight != 75 || data.Remaining != 15 {
+		t.Errorf("the datastore has %+v, want 75 lbs at 15%%", data)
+	}
+	if _, ok := m.alerts.Active(AlertLow); !ok {
+		t.Errorf("the low alert should be active")
+	}
+}
@@ -2,35 +2,230 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"sync"
 	"time"
 )
 
+// Notifier is somewhere alerts get posted for everyone to see
+type Notifier interface {
+	SendMessage(message string) error
+	// SendAlert posts an alert. Mentions are Discord mentions of people to
+	// pull in on top of whoever normally gets pinged; notifiers that
+	// aren't Discord ignore them.
+	SendAlert(level AlertLevel, message string, mentions ...string) error
+}
+
+// DirectMessenger is a Notifier that can also message people directly,
+// for alert subscriptions and escalations (that's Discord)
+type DirectMessenger interface {
+	SendDM(userID, message string) error
+}
+
+// BrokerStatus says whether the MQTT broker is reachable (that's
+// MQTTListener), and since when and why not if it isn't
+type BrokerStatus interface {
+	Down() (bool, time.Time, error)
+}
+
+// How long the scale can go quiet before we complain (and the publisher
+// says it's stale)
+const defaultStaleAfter = 30 * time.Minute
+
+// outgoing is something for check to post once it has let go of the lock,
+// so a slow Discord doesn't hold up everything else
+type outgoing struct {
+	level    AlertLevel
+	message  string
+	mentions []string
+	// Who to DM about it, and what to say
+	dmTo []string
+	dm   string
+	// Alerts and reminders get recorded as notified once they're posted,
+	// plain messages are just posted
+	plain    bool
+	reminder bool
+	escalate bool
+}
+
 // PropaneMonitor manages the background check loop
 type PropaneMonitor struct {
-	discordClient  *DiscordBot // Your Discord bot/webhook client
-	datastore      *Datastore  // Component that reads the cylinder/propane value
-	checkInterval  time.Duration
-	alertThreshold float64
+	notifiers         []Notifier          // Everywhere alerts get posted
+	dms               DirectMessenger     // The first notifier that can DM people, if any
+	datastore         ReadingSource       // Component that reads the cylinder/propane value
+	subscriptions     *SubscriptionStore  // Who wants a DM for which alerts
+	alerts            *AlertStore         // Which alerts are firing and who acknowledged them
+	orders            *OrderStore         // Where we're at with getting a new cylinder
+	history           *ConsumptionHistory // How fast we've been using gas
+	broker            BrokerStatus        // Whether we can reach the MQTT broker, nil if MQTT is turned off
+	calibration       *CalibrationStore   // When the scale was last calibrated, nil if we don't care
+	checkInterval     time.Duration
+	alertThreshold    float64
+	criticalThreshold float64
+	// Order once the forecast says we'll run out within the supplier's
+	// lead time plus a safety margin. No lead time means no reorder alert.
+	leadTime     time.Duration
+	safetyMargin time.Duration
+	// How long the scale can go quiet before we complain
+	staleAfter time.Duration
+	// Same for not being able to reach the MQTT broker
+	brokerDownAfter time.Duration
+	// And for the weight not making sense for the cylinder, which it
+	// won't for a few minutes while it's being swapped
+	tankStateAfter time.Duration
+	// Dropping more than this many lbs within leakWindow smells like a leak
+	leakDrop   float64
+	leakWindow time.Duration
+	// The weight jumping up to at least refillLevel % (see Refilled) means
+	// somebody put a fresh cylinder on the scale
+	refillLevel float64
+	// How unacknowledged alerts get chased up
+	renotifyEvery    time.Duration
+	escalateAfter    time.Duration
+	escalationUserID string
+	escalationRoleID string
+	// What time it is, nil for the bot's clock
+	clock Clock
+
+	// Guards the settings above, which can change when config.json does
+	lock   sync.Mutex
+	ticker *time.Ticker
+
+	started time.Time
+	// Readings seen over the last leakWindow, oldest first
+	recent []CurrentData
+	// The last reading with a cylinder on the scale, however long ago, to
+	// tell a refill from
+	lastReading CurrentData
+	// What the weight says about the cylinder, and since when
+	tankState      TankState
+	tankStateSince time.Time
+	// Alerts the subscribers have already been DMed about, so retrying
+	// the channels doesn't DM them again
+	dmed map[AlertLevel]bool
+	// What the check in progress wants to send
+	outbox []outgoing
 }
 
-func NewPropaneMonitor(dc *DiscordBot, ds *Datastore, interval time.Duration) *PropaneMonitor {
+// NewPropaneMonitor sets up the monitor. Alerts go wherever AddNotifier
+// says.
+func NewPropaneMonitor(ds ReadingSource, subs *SubscriptionStore, alerts *AlertStore, orders *OrderStore, history *ConsumptionHistory, interval time.Duration) *PropaneMonitor {
 	return &PropaneMonitor{
-		discordClient:  dc,
-		datastore:      ds,
-		checkInterval:  interval,
-		alertThreshold: 20.0,
+		datastore:         ds,
+		subscriptions:     subs,
+		alerts:            alerts,
+		orders:            orders,
+		history:           history,
+		checkInterval:     interval,
+		alertThreshold:    20.0,
+		criticalThreshold: 10.0,
+		staleAfter:        defaultStaleAfter,
+		brokerDownAfter:   15 * time.Minute,
+		tankStateAfter:    15 * time.Minute,
+		leakDrop:          10.0,
+		leakWindow:        time.Hour,
+		refillLevel:       80.0,
+		renotifyEvery:     12 * time.Hour,
+		escalateAfter:     48 * time.Hour,
+		dmed:              map[AlertLevel]bool{},
+	}
+}
+
+// AddNotifier adds somewhere for alerts to go
+func (pm *PropaneMonitor) AddNotifier(n Notifier) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.notifiers = append(pm.notifiers, n)
+	if dm, ok := n.(DirectMessenger); ok && pm.dms == nil {
+		pm.dms = dm
 	}
 }
 
+// SetAlertConfig applies the alert settings from the config, keeping the
+// defaults for anything left out
+func (pm *PropaneMonitor) SetAlertConfig(cfg AlertConfig) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	if cfg.LowThreshold > 0 {
+		pm.alertThreshold = cfg.LowThreshold
+	}
+	if cfg.CriticalThreshold > 0 {
+		pm.criticalThreshold = cfg.CriticalThreshold
+	}
+	if cfg.RenotifyEvery.Duration > 0 {
+		pm.renotifyEvery = cfg.RenotifyEvery.Duration
+	}
+	if cfg.EscalateAfter.Duration > 0 {
+		pm.escalateAfter = cfg.EscalateAfter.Duration
+	}
+	pm.escalationUserID = cfg.EscalationUserID
+	pm.escalationRoleID = cfg.EscalationRoleID
+	pm.leadTime = cfg.SupplierLeadTime.Duration
+	pm.safetyMargin = cfg.SafetyMargin.Duration
+	if cfg.BrokerDownAfter.Duration > 0 {
+		pm.brokerDownAfter = cfg.BrokerDownAfter.Duration
+	}
+}
+
+// WatchBroker has the monitor alert when the MQTT broker has been
+// unreachable for too long
+func (pm *PropaneMonitor) WatchBroker(l BrokerStatus) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.broker = l
+}
+
+// WatchCalibration has the monitor remind people when the scale is due to
+// be calibrated again
+func (pm *PropaneMonitor) WatchCalibration(c *CalibrationStore) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.calibration = c
+}
+
+// SetInterval changes how often the monitor checks the level
+func (pm *PropaneMonitor) SetInterval(interval time.Duration) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	pm.checkInterval = interval
+	if pm.ticker != nil {
+		pm.ticker.Reset(interval)
+	}
+}
+
+// SetClock changes the clock the monitor checks by
+func (pm *PropaneMonitor) SetClock(c Clock) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.clock = c
+}
+
+func (pm *PropaneMonitor) now() time.Time {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	return nowFrom(pm.clock)
+}
+
 // Start runs the monitoring loop in a background thread
 func (pm *PropaneMonitor) Start(ctx context.Context) {
-	ticker := time.NewTicker(pm.checkInterval)
+	pm.lock.Lock()
+	pm.ticker = time.NewTicker(pm.checkInterval)
+	ticker := pm.ticker
+	pm.started = nowFrom(pm.clock)
+	pm.lock.Unlock()
 	defer ticker.Stop()
 
+	// Check every new reading (or new percentage, when the cylinder
+	// settings change) as it comes in, rather than waiting for the ticker
+	updates, stop := pm.datastore.Watch()
+	defer stop()
+
 	log.Println("Background propane monitor started...")
-	alertSent := false
 
 	for {
 		select {
@@ -38,32 +233,313 @@ func (pm *PropaneMonitor) Start(ctx context.Context) {
 			log.Println("Stopping propane monitor...")
 			return
 		case <-ticker.C:
-			// Fetch the current percentage level from the datastore
-			currentLevel := pm.datastore.Get().Remaining
-
-			log.Printf("Current propane level: %.2f%%\n", currentLevel)
-
-			// Alert condition
-			if currentLevel < pm.alertThreshold {
-				if !alertSent {
-					message := fmt.Sprintf("Hey <@%s>! The cylinder has dropped below %.0f%%! Current level: %.2f%%.\nMight wanna think about ordering a new one.", pm.discordClient.UserID, pm.alertThreshold, currentLevel)
-
-					// Send notification to your specific Discord channel/user
-					err := pm.discordClient.SendMessage(message)
-					if err != nil {
-						log.Printf("Failed to send Discord alert: %v\n", err)
-					} else {
-						log.Println("Discord alert sent successfully.")
-						alertSent = true
-					}
-				}
-			} else {
-				// Reset the alert state once the tank is refilled above the threshold
-				if alertSent {
-					log.Println("Propane levels restored above threshold. Resetting alert trigger.")
-					alertSent = false
+			pm.check(pm.now())
+		case <-updates:
+			pm.check(pm.now())
+		}
+	}
+}
+
+// check works out which alerts should be going off (and whether anybody
+// needs reminding about them), then sends whatever needs sending
+func (pm *PropaneMonitor) check(now time.Time) {
+	outbox, notifiers, dms := pm.decide(now)
+	for _, o := range outbox {
+		send(now, o, notifiers, dms, pm.alerts)
+	}
+}
+
+// decide does the working out for check, with the lock held. It returns
+// what to send and where to send it.
+func (pm *PropaneMonitor) decide(now time.Time) ([]outgoing, []Notifier, DirectMessenger) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.outbox = nil
+
+	// Fetch the current reading from the datastore
+	current := pm.datastore.Get()
+	pm.track(current, now)
+
+	currentLevel := current.Remaining
+	log.Printf("Current propane level: %.2f%%\n", currentLevel)
+
+	hasReading := !current.TimeStamp.IsZero()
+
+	// With no cylinder on the scale we can't tell how much gas there is,
+	// so leave those alerts be until it's back rather than resolving them
+	// (or setting them off) every time somebody lifts it
+	if current.State != TankNoCylinder {
+		pm.evaluate(now, AlertLow, hasReading && currentLevel < pm.alertThreshold, func() string {
+			return fmt.Sprintf("The cylinder has dropped below %.0f%%! Current level: %.2f%%.\nMight wanna think about ordering a new one.", pm.alertThreshold, currentLevel)
+		})
+
+		pm.evaluate(now, AlertCritical, hasReading && currentLevel < pm.criticalThreshold, func() string {
+			return fmt.Sprintf("The cylinder is almost empty! Current level: %.2f%%.\nIf nobody has ordered a new one yet, now would be a great time.", currentLevel)
+		})
+	}
+
+	forecast, haveForecast := pm.history.Forecast()
+	orderWithin := (pm.leadTime + pm.safetyMargin).Hours() / 24
+	pm.evaluate(now, AlertReorder, pm.leadTime > 0 && haveForecast && forecast.DaysRemaining < orderWithin, func() string {
+		return fmt.Sprintf("%s\nThe supplier takes about %.0f days, so it's time to order a new one.", forecast.Describe(), pm.leadTime.Hours()/24)
+	})
+
+	drop, ok := pm.recentDrop()
+	pm.evaluate(now, AlertLeak, ok && drop > pm.leakDrop, func() string {
+		return fmt.Sprintf("The cylinder lost %.1f lbs in the last %s. That's a lot, is something leaking (or left on)?", drop, pm.leakWindow)
+	})
+
+	// The weight not making sense only counts once it's stayed that way
+	// for a while
+	stuck := func(state TankState) bool {
+		return hasReading && pm.tankState == state && now.Sub(pm.tankStateSince) >= pm.tankStateAfter
+	}
+	pm.evaluate(now, AlertNoCylinder, stuck(TankNoCylinder), func() string {
+		return fmt.Sprintf("There hasn't been a cylinder on the scale since %s (it says %.1f lbs). Did the new one not make it back on?", FormatTimeAgo(pm.tankStateSince, now), current.Weight)
+	})
+	pm.evaluate(now, AlertOverFull, stuck(TankOverFull), func() string {
+		return fmt.Sprintf("The cylinder weighs %.1f lbs, which is more than a full one should. Either it's been overfilled, it's a different cylinder and the cylinder settings need updating, or something's sitting on the scale.", current.Weight)
+	})
+	pm.evaluate(now, AlertBelowTare, stuck(TankBelowTare), func() string {
+		return fmt.Sprintf("The cylinder weighs %.1f lbs, which is less than an empty one should. The tare weight in the cylinder settings is probably off, so the percentages are too.", current.Weight)
+	})
+
+	// Until the first reading arrives, count from when we started
+	lastHeard := current.TimeStamp
+	if !hasReading {
+		lastHeard = pm.started
+	}
+	pm.evaluate(now, AlertStale, now.Sub(lastHeard) > pm.staleAfter, func() string {
+		if !hasReading {
+			return fmt.Sprintf("I haven't gotten a single reading from the scale since I started %s ago. Is it plugged in?", now.Sub(pm.started).Round(time.Minute))
+		}
+		return fmt.Sprintf("I haven't heard from the scale since %s. Is it still plugged in?", FormatTimeAgo(current.TimeStamp, now))
+	})
+
+	if pm.broker != nil {
+		down, since, err := pm.broker.Down()
+		pm.evaluate(now, AlertBroker, down && !since.IsZero() && now.Sub(since) > pm.brokerDownAfter, func() string {
+			message := fmt.Sprintf("I haven't been able to reach the MQTT broker since %s, so no readings are getting through.", FormatTimeAgo(since, now))
+			if err != nil {
+				message += fmt.Sprintf("\nLast error: %v", err)
+			}
+			return message
+		})
+	}
+
+	if pm.calibration != nil {
+		_, due := pm.calibration.Due(now)
+		pm.evaluate(now, AlertCalibration, due, func() string {
+			last, _ := pm.calibration.Current()
+			return fmt.Sprintf("The scale was last calibrated %s, so it's due for another one before it drifts too far. There's a walkthrough at /calibration on the web page.", FormatTimeAgo(last.At, now))
+		})
+	}
+	return pm.outbox, slices.Clone(pm.notifiers), pm.dms
+}
+
+// evaluate records the alert for the given level when its condition first
+// becomes true, sends it (until that works), chases it up until somebody
+// acknowledges it, and resolves it once the condition clears
+func (pm *PropaneMonitor) evaluate(now time.Time, level AlertLevel, firing bool, message func() string) {
+	active, isActive := pm.alerts.Active(level)
+
+	if !firing {
+		delete(pm.dmed, level)
+		if isActive {
+			log.Printf("Propane %s alert condition cleared. Resetting alert trigger.\n", level)
+			if err := pm.alerts.Resolve(level, now); err != nil {
+				log.Printf("Failed to save alerts: %v\n", err)
+			}
+		}
+		return
+	}
+	if !isActive {
+		// Recorded whether or not we can tell anybody, so MQTT, Home
+		// Assistant and the orders still know about it
+		log.Printf("Propane %s alert condition triggered.\n", level)
+		if err := pm.alerts.Fire(level, now); err != nil {
+			log.Printf("Failed to save alerts: %v\n", err)
+		}
+
+		// Running low means we need a new cylinder, if nobody's on it already
+		if level.NeedsOrder() {
+			if _, ok := pm.orders.Current(); !ok {
+				if _, err := pm.orders.Advance(OrderNeeded, now, OrderDetails{}); err != nil {
+					log.Printf("Failed to save orders: %v\n", err)
 				}
 			}
 		}
+	} else if !active.LastNotified.IsZero() {
+		pm.chase(now, active)
+		return
+	}
+
+	// With Discord turned off there's nobody to send it to. It gets sent
+	// if it's turned on later.
+	if len(pm.notifiers) == 0 {
+		return
+	}
+
+	// Send notification to your specific Discord channel/user
+	o := outgoing{level: level, message: message()}
+
+	// And let everyone who asked for it know directly, even if the
+	// channels are down
+	if pm.dms != nil && !pm.dmed[level] {
+		o.dmTo = pm.subscriptions.Subscribers(level)
+		o.dm = fmt.Sprintf("Propane %s alert: %s\n(Use /unsubscribe to stop these.)", level, o.message)
+		pm.dmed[level] = true
+	}
+	pm.outbox = append(pm.outbox, o)
+}
+
+// chase re-posts an alert nobody has acknowledged yet, pulling in the
+// escalation user/role once it has been ignored for long enough
+func (pm *PropaneMonitor) chase(now time.Time, alert Alert) {
+	if alert.Acked() {
+		return
+	}
+
+	escalate := !alert.Escalated && now.Sub(alert.FiredAt) >= pm.escalateAfter &&
+		(pm.escalationUserID != "" || pm.escalationRoleID != "")
+	if !escalate && now.Sub(alert.LastNotified) < pm.renotifyEvery {
+		return
+	}
+
+	message := fmt.Sprintf("Reminder: the %s alert from %s still hasn't been acknowledged. %s",
+		alert.Level, FormatTimeAgo(alert.FiredAt, now), pm.datastore.GetString())
+	var who []string
+	if escalate {
+		if pm.escalationUserID != "" {
+			who = append(who, fmt.Sprintf("<@%s>", pm.escalationUserID))
+		}
+		if pm.escalationRoleID != "" {
+			who = append(who, fmt.Sprintf("<@&%s>", pm.escalationRoleID))
+		}
+		message = fmt.Sprintf("Nobody has acknowledged the %s alert in %s. Can someone take a look?\n%s",
+			alert.Level, now.Sub(alert.FiredAt).Round(time.Minute), pm.datastore.GetString())
+	}
+
+	o := outgoing{level: alert.Level, message: message, mentions: who, reminder: true, escalate: escalate}
+	if escalate && pm.escalationUserID != "" && pm.dms != nil {
+		o.dmTo, o.dm = []string{pm.escalationUserID}, message
+	}
+	pm.outbox = append(pm.outbox, o)
+}
+
+// Remembers readings within the leak window so we can tell how fast the
+// weight is dropping, and how long the weight has (or hasn't) made sense
+func (pm *PropaneMonitor) track(current CurrentData, now time.Time) {
+	if current.TimeStamp.IsZero() {
+		return
+	}
+	if current.State != pm.tankState {
+		pm.tankState = current.State
+		pm.tankStateSince = current.TimeStamp
+	}
+	// Lifting the cylinder off isn't a leak, and putting a new one on is
+	// a refill however long it was off for (or the scale was quiet)
+	if current.State == TankNoCylinder {
+		return
+	}
+	if !pm.lastReading.TimeStamp.Equal(current.TimeStamp) {
+		if !pm.lastReading.TimeStamp.IsZero() {
+			pm.checkRefill(pm.lastReading, current, now)
+		}
+		pm.lastReading = current
+		pm.recent = append(pm.recent, current)
+	}
+	for len(pm.recent) > 0 && now.Sub(pm.recent[0].TimeStamp) > pm.leakWindow {
+		pm.recent = pm.recent[1:]
+	}
+}
+
+// recentDrop is how much weight was lost across the readings we're
+// tracking. It's only meaningful once they cover most of the leak window.
+func (pm *PropaneMonitor) recentDrop() (float64, bool) {
+	if len(pm.recent) < 2 {
+		return 0, false
+	}
+	first, last := pm.recent[0], pm.recent[len(pm.recent)-1]
+	if last.TimeStamp.Sub(first.TimeStamp) < pm.leakWindow/2 {
+		return 0, false
+	}
+	return first.Weight - last.Weight, true
+}
+
+// checkRefill closes out the current order when a fresh cylinder shows up
+// on the scale
+func (pm *PropaneMonitor) checkRefill(previous, current CurrentData, now time.Time) {
+	if !Refilled(previous.Weight, current.Weight) || current.Remaining < pm.refillLevel {
+		return
+	}
+	log.Printf("Weight jumped from %.1f to %.1f lbs, looks like a new cylinder\n", previous.Weight, current.Weight)
+
+	if _, ok := pm.orders.Current(); !ok {
+		return
+	}
+	order, err := pm.orders.Advance(OrderInstalled, now, OrderDetails{})
+	if err != nil {
+		log.Printf("Failed to close out the order: %v\n", err)
+		return
+	}
+	message := fmt.Sprintf("Looks like a fresh cylinder was just put on the scale (%.0f%%). %s.", current.Remaining, order.Describe())
+	pm.outbox = append(pm.outbox, outgoing{message: message, plain: true})
+}
+
+// send posts something check decided to send, and records alerts and
+// reminders as notified once they've been posted. It's called without the
+// monitor's lock held, since it talks to Discord.
+func send(now time.Time, o outgoing, notifiers []Notifier, dms DirectMessenger, alerts *AlertStore) {
+	if o.plain {
+		for _, n := range notifiers {
+			if err := n.SendMessage(o.message); err != nil {
+				log.Printf("Failed to send message: %v\n", err)
+			}
+		}
+		return
+	}
+
+	err := notify(notifiers, o.level, o.message, o.mentions...)
+	if dms != nil {
+		for _, id := range o.dmTo {
+			if err := dms.SendDM(id, o.dm); err != nil {
+				log.Printf("Failed to DM %s about the %s alert: %v\n", id, o.level, err)
+			}
+		}
+	}
+	what := "alert"
+	if o.reminder {
+		what = "reminder"
+	}
+	if err != nil {
+		log.Printf("Failed to send %s %s: %v\n", o.level, what, err)
+		return
+	}
+	log.Printf("Propane %s %s sent successfully.\n", o.level, what)
+	if err := alerts.Notified(o.level, now, o.escalate); err != nil {
+		log.Printf("Failed to save alerts: %v\n", err)
+	}
+}
+
+// notify posts the alert everywhere it should go. It only counts as a
+// failure if it couldn't be posted anywhere, including when there's
+// nowhere to post it.
+func notify(notifiers []Notifier, level AlertLevel, message string, mentions ...string) error {
+	if len(notifiers) == 0 {
+		return errors.New("there's nowhere to post alerts (Discord is turned off)")
+	}
+	var errs []error
+	for _, n := range notifiers {
+		if err := n.SendAlert(level, message, mentions...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 && len(errs) == len(notifiers) {
+		return errors.Join(errs...)
+	}
+	if len(errs) > 0 {
+		log.Printf("Some notifiers couldn't post the %s alert: %v\n", level, errors.Join(errs...))
 	}
+	return nil
 }
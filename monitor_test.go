@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type sentAlert struct {
+	Level    AlertLevel
+	Message  string
+	Mentions []string
+}
+
+// fakeNotifier remembers everything it was asked to send, instead of
+// sending it
+type fakeNotifier struct {
+	lock     sync.Mutex
+	alerts   []sentAlert
+	messages []string
+	dms      map[string][]string
+	// Makes sending fail, like Discord being down
+	fail bool
+}
+
+func (n *fakeNotifier) SendMessage(message string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.fail {
+		return errors.New("can't send")
+	}
+	n.messages = append(n.messages, message)
+	return nil
+}
+
+func (n *fakeNotifier) SendAlert(level AlertLevel, message string, mentions ...string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.fail {
+		return errors.New("can't send")
+	}
+	n.alerts = append(n.alerts, sentAlert{level, message, mentions})
+	return nil
+}
+
+func (n *fakeNotifier) SendDM(userID, message string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.dms == nil {
+		n.dms = map[string][]string{}
+	}
+	n.dms[userID] = append(n.dms[userID], message)
+	return nil
+}
+
+// sent returns the alerts sent so far
+func (n *fakeNotifier) sent() []sentAlert {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return slices.Clone(n.alerts)
+}
+
+func (n *fakeNotifier) levels() []AlertLevel {
+	var levels []AlertLevel
+	for _, a := range n.sent() {
+		levels = append(levels, a.Level)
+	}
+	return levels
+}
+
+type testMonitor struct {
+	*PropaneMonitor
+	ds       *Datastore
+	cylinder *CylinderStore
+	notifier *fakeNotifier
+	subs     *SubscriptionStore
+	alerts   *AlertStore
+	orders   *OrderStore
+}
+
+// newTestMonitor sets up a monitor with its state in a temp dir and alerts
+// going to a fakeNotifier
+func newTestMonitor(t *testing.T) *testMonitor {
+	t.Helper()
+	dir := t.TempDir()
+	cyl := newTestCylinderStore(t)
+	ds := NewDatastore(cyl)
+	cyl.OnChange(ds.Refresh)
+	m := &testMonitor{
+		ds:       ds,
+		cylinder: cyl,
+		notifier: &fakeNotifier{},
+		subs:     NewSubscriptionStore(filepath.Join(dir, subscriptionsFile)),
+		alerts:   NewAlertStore(filepath.Join(dir, alertsFile)),
+		orders:   NewOrderStore(filepath.Join(dir, ordersFile)),
+	}
+	history := NewConsumptionHistory(filepath.Join(dir, historyFile), ds, cyl)
+	m.PropaneMonitor = NewPropaneMonitor(ds, m.subs, m.alerts, m.orders, history, time.Minute)
+	m.AddNotifier(m.notifier)
+	return m
+}
+
+// reading puts a reading in the datastore, the way the Ingester would
+func (m *testMonitor) reading(weight float64, at time.Time) {
+	m.ds.Set(weight, at)
+}
+
+var monitorStart = time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func TestMonitorLowAlert(t *testing.T) {
+	m := newTestMonitor(t)
+	if err := m.subs.Subscribe("123", []AlertLevel{AlertLow}); err != nil {
+		t.Fatal(err)
+	}
+	now := monitorStart
+
+	m.reading(100, now)
+	m.check(now)
+	if got := m.notifier.sent(); len(got) != 0 {
+		t.Fatalf("40%% shouldn't set anything off, got %+v", got)
+	}
+
+	// Dropping to 15% sets off the low alert but not the critical one
+	now = now.Add(time.Minute)
+	m.reading(75, now)
+	m.check(now)
+	if got := m.notifier.levels(); !slices.Equal(got, []AlertLevel{AlertLow}) {
+		t.Fatalf("alerts sent = %v, want just low", got)
+	}
+	if a, ok := m.alerts.Active(AlertLow); !ok || !a.FiredAt.Equal(now) {
+		t.Errorf("the low alert should be active since %s, got %+v", now, a)
+	}
+	if got := m.notifier.dms["123"]; len(got) != 1 {
+		t.Errorf("the subscriber got %d DMs, want 1", len(got))
+	}
+	if o, ok := m.orders.Current(); !ok || o.State != OrderNeeded {
+		t.Errorf("running low should start an order, got %+v", o)
+	}
+
+	// It's only sent once
+	now = now.Add(time.Minute)
+	m.reading(75, now)
+	m.check(now)
+	if got := m.notifier.sent(); len(got) != 1 {
+		t.Errorf("the alert was sent %d times, want once", len(got))
+	}
+
+	// And goes away with a fresh cylinder
+	now = now.Add(time.Minute)
+	m.reading(158, now)
+	m.check(now)
+	if _, ok := m.alerts.Active(AlertLow); ok {
+		t.Errorf("the low alert should have been resolved")
+	}
+	if o, ok := m.orders.Current(); ok {
+		t.Errorf("the fresh cylinder should have closed out the order, got %+v", o)
+	}
+}
+
+func TestMonitorCriticalAlert(t *testing.T) {
+	m := newTestMonitor(t)
+	m.reading(65, monitorStart)
+	m.check(monitorStart)
+
+	if got := m.notifier.levels(); !slices.Equal(got, []AlertLevel{AlertLow, AlertCritical}) {
+		t.Errorf("alerts sent = %v, want low and critical", got)
+	}
+}
+
+func TestMonitorThresholdsFromConfig(t *testing.T) {
+	m := newTestMonitor(t)
+	m.SetAlertConfig(AlertConfig{LowThreshold: 50, CriticalThreshold: 30})
+	m.reading(100, monitorStart)
+	m.check(monitorStart)
+
+	if got := m.notifier.levels(); !slices.Equal(got, []AlertLevel{AlertLow}) {
+		t.Errorf("alerts sent = %v, want just low", got)
+	}
+}
+
+func TestMonitorStaleAlert(t *testing.T) {
+	m := newTestMonitor(t)
+	m.reading(150, monitorStart)
+
+	m.check(monitorStart.Add(29 * time.Minute))
+	if got := m.notifier.sent(); len(got) != 0 {
+		t.Fatalf("nothing should go off yet, got %+v", got)
+	}
+
+	m.check(monitorStart.Add(31 * time.Minute))
+	got := m.notifier.sent()
+	if len(got) != 1 || got[0].Level != AlertStale || !strings.Contains(got[0].Message, "31 minutes ago") {
+		t.Fatalf("alerts sent = %+v, want a stale one saying when we last heard from the scale", got)
+	}
+
+	m.reading(150, monitorStart.Add(32*time.Minute))
+	m.check(monitorStart.Add(32 * time.Minute))
+	if _, ok := m.alerts.Active(AlertStale); ok {
+		t.Errorf("a new reading should have resolved the stale alert")
+	}
+}
+
+func TestMonitorLeakAlert(t *testing.T) {
+	m := newTestMonitor(t)
+	for i := range 7 {
+		now := monitorStart.Add(time.Duration(i) * 10 * time.Minute)
+		m.reading(155-float64(i)*2, now)
+		m.check(now)
+	}
+	if got := m.notifier.levels(); !slices.Equal(got, []AlertLevel{AlertLeak}) {
+		t.Errorf("alerts sent = %v, want a leak alert after losing 12 lbs in an hour", got)
+	}
+}
+
+func TestMonitorChasesUnacknowledgedAlerts(t *testing.T) {
+	m := newTestMonitor(t)
+	m.SetAlertConfig(AlertConfig{
+		RenotifyEvery:    Duration{12 * time.Hour},
+		EscalateAfter:    Duration{48 * time.Hour},
+		EscalationUserID: "456",
+	})
+	at := func(d time.Duration) time.Time {
+		now := monitorStart.Add(d)
+		m.reading(75, now)
+		m.check(now)
+		return now
+	}
+
+	at(0)
+	at(11 * time.Hour)
+	if got := len(m.notifier.sent()); got != 1 {
+		t.Fatalf("%d alerts sent before it's time to remind anyone, want 1", got)
+	}
+
+	at(12 * time.Hour)
+	got := m.notifier.sent()
+	if len(got) != 2 || !strings.HasPrefix(got[1].Message, "Reminder") || len(got[1].Mentions) != 0 {
+		t.Fatalf("alerts sent = %+v, want a reminder without pulling anyone else in", got)
+	}
+
+	at(48 * time.Hour)
+	got = m.notifier.sent()
+	if len(got) != 3 || !slices.Equal(got[2].Mentions, []string{"<@456>"}) {
+		t.Fatalf("alerts sent = %+v, want an escalation mentioning the escalation user", got)
+	}
+	if len(m.notifier.dms["456"]) != 1 {
+		t.Errorf("the escalation user should have been DMed")
+	}
+	if a, _ := m.alerts.Active(AlertLow); !a.Escalated {
+		t.Errorf("the alert should be marked as escalated")
+	}
+
+	// Once somebody deals with it, we stop bugging people
+	if _, err := m.alerts.Ack(AlertLow, "789", "someone", monitorStart.Add(49*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	at(100 * time.Hour)
+	if got := len(m.notifier.sent()); got != 3 {
+		t.Errorf("%d alerts sent after it was acknowledged, want no more than 3", got)
+	}
+}
+
+func TestMonitorRetriesWhenNotifiersFail(t *testing.T) {
+	m := newTestMonitor(t)
+	m.notifier.fail = true
+	m.reading(75, monitorStart)
+	m.check(monitorStart)
+	a, ok := m.alerts.Active(AlertLow)
+	if !ok {
+		t.Fatalf("the alert should be recorded even though it couldn't be sent")
+	}
+	if !a.LastNotified.IsZero() {
+		t.Errorf("an alert nobody heard about shouldn't count as sent")
+	}
+
+	m.notifier.fail = false
+	m.check(monitorStart.Add(time.Minute))
+	if got := m.notifier.levels(); !slices.Equal(got, []AlertLevel{AlertLow}) {
+		t.Errorf("alerts sent = %v, want the low alert once sending works again", got)
+	}
+	if a, _ := m.alerts.Active(AlertLow); !a.LastNotified.Equal(monitorStart.Add(time.Minute)) || !a.FiredAt.Equal(monitorStart) {
+		t.Errorf("alert = %+v, want it fired at the start and sent a minute later", a)
+	}
+}
+
+// Subscribers hear what went wrong, once, even when the channels are down
+func TestMonitorDMsWhenNotifiersFail(t *testing.T) {
+	m := newTestMonitor(t)
+	if err := m.subs.Subscribe("123", []AlertLevel{AlertStale}); err != nil {
+		t.Fatal(err)
+	}
+	m.notifier.fail = true
+	m.reading(150, monitorStart)
+	m.check(monitorStart.Add(time.Hour))
+	m.check(monitorStart.Add(time.Hour + time.Minute))
+
+	got := m.notifier.dms["123"]
+	if len(got) != 1 || !strings.Contains(got[0], "haven't heard from the scale") {
+		t.Fatalf("DMs = %q, want one saying the scale has gone quiet", got)
+	}
+
+	// The channels still get it once they're back, without DMing again
+	m.notifier.fail = false
+	m.check(monitorStart.Add(time.Hour + 2*time.Minute))
+	if got := m.notifier.levels(); !slices.Equal(got, []AlertLevel{AlertStale}) {
+		t.Errorf("alerts sent = %v, want the stale alert", got)
+	}
+	if got := m.notifier.dms["123"]; len(got) != 1 {
+		t.Errorf("the subscriber got %d DMs, want 1", len(got))
+	}
+}
+
+// With Discord off nobody hears about alerts, but they're
+// still recorded for MQTT, Home Assistant and the orders
+func TestMonitorNoNotifiers(t *testing.T) {
+	m := newTestMonitor(t)
+	m.notifiers = nil
+	m.reading(75, monitorStart)
+	m.check(monitorStart)
+	if a, ok := m.alerts.Active(AlertLow); !ok || !a.LastNotified.IsZero() {
+		t.Errorf("alert = %+v, %v, want it recorded but not sent", a, ok)
+	}
+	if o, ok := m.orders.Current(); !ok || o.State != OrderNeeded {
+		t.Errorf("running low should start an order, got %+v", o)
+	}
+
+	// Turning one on sends it
+	m.AddNotifier(m.notifier)
+	m.check(monitorStart.Add(time.Minute))
+	if got := m.notifier.levels(); !slices.Equal(got, []AlertLevel{AlertLow}) {
+		t.Errorf("alerts sent = %v, want the low alert once there's somewhere to send it", got)
+	}
+}
+
+// stuckNotifier takes its time posting alerts, like Discord having a bad
+// day
+type stuckNotifier struct {
+	fakeNotifier
+	posting chan struct{}
+	release chan struct{}
+}
+
+func (n *stuckNotifier) SendAlert(level AlertLevel, message string, mentions ...string) error {
+	n.posting <- struct{}{}
+	<-n.release
+	return n.fakeNotifier.SendAlert(level, message, mentions...)
+}
+
+// A slow send doesn't hold up config changes
+func TestMonitorSendsWithoutTheLock(t *testing.T) {
+	m := newTestMonitor(t)
+	stuck := &stuckNotifier{posting: make(chan struct{}), release: make(chan struct{})}
+	m.notifiers = []Notifier{stuck}
+	m.reading(75, monitorStart)
+
+	checked := make(chan struct{})
+	go func() {
+		m.check(monitorStart)
+		close(checked)
+	}()
+	<-stuck.posting
+
+	changed := make(chan struct{})
+	go func() {
+		m.SetAlertConfig(AlertConfig{LowThreshold: 30})
+		m.SetInterval(time.Hour)
+		close(changed)
+	}()
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Errorf("changing the config waited for the alert to be sent")
+	}
+
+	close(stuck.release)
+	<-checked
+	if a, _ := m.alerts.Active(AlertLow); a.LastNotified.IsZero() {
+		t.Errorf("the alert should be recorded as sent once it was")
+	}
+}
+
+func TestMonitorOneFailingNotifierIsFine(t *testing.T) {
+	m := newTestMonitor(t)
+	broken := &fakeNotifier{fail: true}
+	m.AddNotifier(broken)
+	m.reading(75, monitorStart)
+	m.check(monitorStart)
+
+	if _, ok := m.alerts.Active(AlertLow); !ok {
+		t.Errorf("the alert got to one notifier, so it should count as sent")
+	}
+}
+
+// downBroker is a BrokerStatus for a broker that went away at a given time
+type downBroker struct{ since time.Time }
+
+func (b downBroker) Down() (bool, time.Time, error) {
+	return true, b.since, errors.New("connection refused")
+}
+
+func TestMonitorBrokerAlert(t *testing.T) {
+	m := newTestMonitor(t)
+	m.WatchBroker(downBroker{monitorStart})
+	m.reading(150, monitorStart)
+
+	m.check(monitorStart.Add(10 * time.Minute))
+	if got := m.notifier.sent(); len(got) != 0 {
+		t.Fatalf("nothing should go off yet, got %+v", got)
+	}
+
+	m.reading(150, monitorStart.Add(16*time.Minute))
+	m.check(monitorStart.Add(16 * time.Minute))
+	got := m.notifier.sent()
+	if len(got) != 1 || got[0].Level != AlertBroker || !strings.Contains(got[0].Message, "connection refused") {
+		t.Errorf("alerts sent = %+v, want a broker alert with the last error", got)
+	}
+}
+
+func TestMonitorChecksOnUpdates(t *testing.T) {
+	m := newTestMonitor(t)
+	// Long enough that the ticker never gets a look in
+	m.checkInterval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Start(ctx)
+	// Let it start watching the datastore
+	time.Sleep(50 * time.Millisecond)
+
+	m.reading(100, Now())
+	time.Sleep(100 * time.Millisecond)
+	if got := m.notifier.sent(); len(got) != 0 {
+		t.Fatalf("40%% shouldn't set anything off, got %+v", got)
+	}
+
+	// Same weight, but it turns out the cylinder is a lot bigger than we
+	// thought, so there's only 10% left
+	if err := m.cylinder.Save(Cylinder{TareWeight: 60, FullWeight: 460}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the low alert", func() bool {
+		_, ok := m.alerts.Active(AlertLow)
+		return ok
+	})
+}
+
+func TestMonitorTankStateAlerts(t *testing.T) {
+	tests := []struct {
+		name   string
+		weight float64
+		want   AlertLevel
+	}{
+		{"no cylinder", 0.5, AlertNoCylinder},
+		{"over full", 180, AlertOverFull},
+		{"below tare", 50, AlertBelowTare},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMonitor(t)
+			at := func(d time.Duration) {
+				now := monitorStart.Add(d)
+				m.reading(tt.weight, now)
+				m.check(now)
+			}
+
+			// Not straight away, it could just be somebody swapping the
+			// cylinder or leaning on the scale
+			at(0)
+			at(10 * time.Minute)
+			if got := m.notifier.levels(); slices.Contains(got, tt.want) {
+				t.Fatalf("alerts sent = %v, the %s alert went off too soon", got, tt.want)
+			}
+
+			at(15 * time.Minute)
+			if got := m.notifier.levels(); !slices.Contains(got, tt.want) {
+				t.Fatalf("alerts sent = %v, want a %s alert", got, tt.want)
+			}
+
+			// And it goes away once the weight makes sense again
+			at(16 * time.Minute)
+			m.reading(150, monitorStart.Add(17*time.Minute))
+			m.check(monitorStart.Add(17 * time.Minute))
+			if _, ok := m.alerts.Active(tt.want); ok {
+				t.Errorf("the %s alert should have been resolved", tt.want)
+			}
+		})
+	}
+}
+
+func TestMonitorSwappingCylinders(t *testing.T) {
+	tests := []struct {
+		name string
+		off  time.Duration
+		// Whether the scale was unplugged while the cylinder was off
+		quiet bool
+		want  []AlertLevel
+	}{
+		{"quick swap", 5 * time.Minute, false, []AlertLevel{AlertLow}},
+		{"off for a couple of hours", 2 * time.Hour, false, []AlertLevel{AlertLow, AlertNoCylinder}},
+		// Longer than the leak window with no readings at all, so there's
+		// nothing left in it to compare the new cylinder with
+		{"scale unplugged for a couple of hours", 2 * time.Hour, true, []AlertLevel{AlertLow, AlertStale}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestMonitor(t)
+			at := func(d time.Duration, weight float64) {
+				now := monitorStart.Add(d)
+				m.reading(weight, now)
+				m.check(now)
+			}
+
+			// Running low, so there's an order in
+			at(0, 75)
+			if _, ok := m.alerts.Active(AlertLow); !ok {
+				t.Fatalf("the low alert should have gone off")
+			}
+
+			// Lifting it off the scale isn't a leak, and doesn't count as
+			// the alert being dealt with
+			for d := time.Minute; d <= tt.off; d += time.Minute {
+				if tt.quiet {
+					m.check(monitorStart.Add(d))
+				} else {
+					at(d, 0)
+				}
+			}
+			if got := m.notifier.levels(); !slices.Equal(got, tt.want) {
+				t.Errorf("alerts sent = %v, want %v", got, tt.want)
+			}
+			if _, ok := m.alerts.Active(AlertLow); !ok {
+				t.Errorf("the low alert shouldn't be resolved just because the cylinder is off the scale")
+			}
+
+			// And the new one going on is a refill
+			at(tt.off+time.Minute, 158)
+			if _, ok := m.alerts.Active(AlertLow); ok {
+				t.Errorf("the low alert should have been resolved")
+			}
+			if o, ok := m.orders.Current(); ok {
+				t.Errorf("the fresh cylinder should have closed out the order, got %+v", o)
+			}
+		})
+	}
+}
+
+func TestMonitorCalibrationReminder(t *testing.T) {
+	m := newTestMonitor(t)
+	calibration := NewCalibrationStore(filepath.Join(t.TempDir(), calibrationFile))
+	calibration.SetReminder(6)
+	m.WatchCalibration(calibration)
+
+	// An install that's never been calibrated doesn't get nagged, however
+	// long it's been running
+	for _, now := range []time.Time{monitorStart, monitorStart.AddDate(1, 0, 0)} {
+		m.reading(150, now)
+		m.check(now)
+	}
+	if got := m.notifier.sent(); len(got) != 0 {
+		t.Fatalf("alerts sent = %+v, want none for a scale that's never been calibrated", got)
+	}
+
+	if err := calibration.AddPoint(CalibrationPoint{Reference: 45, Raw: 45.5, At: monitorStart}); err != nil {
+		t.Fatal(err)
+	}
+	calibrated := monitorStart.AddDate(1, 0, 0)
+	if _, err := calibration.Finish(calibrated, "Sam"); err != nil {
+		t.Fatal(err)
+	}
+	later := calibrated.AddDate(0, 6, -1)
+	m.reading(150, later)
+	m.check(later)
+	if got := m.notifier.sent(); len(got) != 0 {
+		t.Fatalf("it's not due yet, but got %+v", got)
+	}
+
+	later = calibrated.AddDate(0, 6, 0)
+	m.reading(150, later)
+	m.check(later)
+	got := m.notifier.sent()
+	if len(got) != 1 || got[0].Level != AlertCalibration || !strings.Contains(got[0].Message, "/calibration") {
+		t.Errorf("alerts sent = %+v, want a calibration reminder saying where to do it", got)
+	}
+}
+
+// The monitor checks by its own clock when it has one
+func TestMonitorClock(t *testing.T) {
+	m := newTestMonitor(t)
+	m.checkInterval = time.Hour
+	now := monitorStart.Add(31 * time.Minute)
+	m.SetClock(fixedClock(now))
+	m.reading(100, monitorStart)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Start(ctx)
+	time.Sleep(50 * time.Millisecond)
+
+	// The scale has been quiet for 31 minutes as far as the monitor's
+	// concerned
+	m.ds.Refresh()
+	waitFor(t, "the stale alert", func() bool {
+		_, ok := m.alerts.Active(AlertStale)
+		return ok
+	})
+	if a, _ := m.alerts.Active(AlertStale); !a.FiredAt.Equal(now) {
+		t.Errorf("the stale alert fired at %s, want %s", a.FiredAt, now)
+	}
+}
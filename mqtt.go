@@ -2,88 +2,432 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"log"
 	"os"
-	"strconv"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
 type MQTTListener struct {
-	Datastore *Datastore
-	// The MQTT server's name with port
-	Server    string
-	// The topic to listen on
-	Topic     string
-	// Cylinder  Cylinder
+	// Where readings go
+	Ingest *Ingester
+	// The server, topic, login and so on, straight from config.json
+	MQTTConfig
+
+	client MQTT.Client
+	// Guards the settings and client, since the settings can change
+	// when config.json does
+	lock sync.Mutex
+	// Tells Run to reconnect to a new server
+	restart chan struct{}
+	// How the connection is doing, for /readyz
+	connected   bool
+	subscribed  bool
+	lastMessage time.Time
+	// When we lost the connection, and why, if we're not connected
+	downSince time.Time
+	lastError error
+	// Called every time we (re)connect
+	onConnect []func()
 }
 
-func (l *MQTTListener) niceDate(unixts string) time.Time {
-	i, err := strconv.ParseInt(unixts, 10, 64)
-	if err != nil {
-		panic(err)
+func (l *MQTTListener) onMessageReceived(client MQTT.Client, message MQTT.Message) {
+	l.lock.Lock()
+	l.lastMessage = time.Now()
+	l.lock.Unlock()
+
+	// payload is in the format: 1577640142,163.4 (see ingest.go)
+	l.Ingest.Accept("mqtt "+message.Topic(), message.Payload())
+}
+
+// Reconfigure applies new settings from config.json. A new topic just
+// gets resubscribed to, anything else means reconnecting.
+func (l *MQTTListener) Reconfigure(cfg MQTTConfig) {
+	l.lock.Lock()
+	sameTopic := cfg
+	sameTopic.Topic = l.Topic
+	if sameTopic != l.MQTTConfig {
+		l.MQTTConfig = cfg
+		if l.restart != nil {
+			select {
+			case l.restart <- struct{}{}:
+			default:
+			}
+		}
+		l.lock.Unlock()
+		return
 	}
-	tm := time.Unix(i, 0)
+	oldTopic := l.Topic
+	l.Topic = cfg.Topic
+	client, qos := l.client, l.QoS
+	l.lock.Unlock()
 
-	local := tm
-	// PS1 is located in Chicago
-	location, err := time.LoadLocation("America/Chicago")
-	if err == nil {
-		local = local.In(location)
+	if oldTopic == cfg.Topic || client == nil || !client.IsConnected() {
+		return
+	}
+	if token := client.Unsubscribe(oldTopic); token.Wait() && token.Error() != nil {
+		log.Printf("Failed to unsubscribe from %s: %v\n", oldTopic, token.Error())
+	}
+	token := client.Subscribe(cfg.Topic, byte(qos), l.onMessageReceived)
+	token.Wait()
+	l.lock.Lock()
+	l.subscribed = token.Error() == nil
+	l.lock.Unlock()
+	if token.Error() != nil {
+		log.Printf("Failed to subscribe to %s: %v\n", cfg.Topic, token.Error())
+		return
 	}
-	return local
+	log.Printf("Now listening on %s instead of %s\n", cfg.Topic, oldTopic)
 }
 
-func (l *MQTTListener) parseWeight(s string) float64 {
-	f, err := strconv.ParseFloat(s, 64)
-	if err != nil {
-		panic(err)
+// ClientIDOrDefault is the configured client ID, or one made from the
+// hostname and working directory. It has to stay the same across restarts
+// for the broker to keep our session.
+func (cfg MQTTConfig) ClientIDOrDefault() string {
+	if cfg.ClientID != "" {
+		return cfg.ClientID
 	}
-	return f
+	hostname, _ := os.Hostname()
+	dir, _ := os.Getwd()
+	sum := sha256.Sum256([]byte(dir))
+	return fmt.Sprintf("propanebot-%s-%x", hostname, sum[:4])
 }
 
-func (l *MQTTListener) onMessageReceived(client MQTT.Client, message MQTT.Message) {
-	//fmt.Printf("Received message on topic: %s\nMessage: %s\n", message.Topic(), message.Payload())
+// TLSConfig builds the TLS settings for the broker connection, or returns
+// nil if there aren't any (ssl:// still works then, with the system CAs)
+func (cfg MQTTConfig) TLSConfig() (*tls.Config, error) {
+	if cfg.CACert == "" && cfg.ClientCert == "" && !cfg.InsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Health is the health check for MQTT: it has to be connected and
+// subscribed. How long since the last message is there too, since a quiet
+// scale is the usual way things go wrong.
+func (l *MQTTListener) Health() (bool, any) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	details := struct {
+		Server         string    `json:"server"`
+		Topic          string    `json:"topic"`
+		Connected      bool      `json:"connected"`
+		Subscribed     bool      `json:"subscribed"`
+		LastMessage    time.Time `json:"lastMessage,omitzero"`
+		LastMessageAge *Duration `json:"lastMessageAge,omitempty"`
+		DownSince      time.Time `json:"downSince,omitzero"`
+		LastError      string    `json:"lastError,omitempty"`
+	}{
+		Server:      l.Server,
+		Topic:       l.Topic,
+		Connected:   l.connected,
+		Subscribed:  l.subscribed,
+		LastMessage: l.lastMessage,
+		DownSince:   l.downSince,
+	}
+	if !l.connected && l.lastError != nil {
+		details.LastError = l.lastError.Error()
+	}
+	if !l.lastMessage.IsZero() {
+		details.LastMessageAge = &Duration{time.Since(l.lastMessage).Round(time.Second)}
+	}
+	return l.connected && l.subscribed, details
+}
+
+var errNotConnected = errors.New("not connected to the MQTT broker")
+
+// OnConnect adds something to do every time we (re)connect to the broker,
+// like publishing everything again in case the broker forgot it
+func (l *MQTTListener) OnConnect(hook func()) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.onConnect = append(l.onConnect, hook)
+}
+
+// Publish sends a message to the broker, if we're connected to it
+func (l *MQTTListener) Publish(topic string, retained bool, payload []byte) error {
+	l.lock.Lock()
+	client, qos := l.client, l.QoS
+	l.lock.Unlock()
+	if client == nil || !client.IsConnectionOpen() {
+		return errNotConnected
+	}
+	token := client.Publish(topic, byte(qos), retained, payload)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("timed out publishing to %s", topic)
+	}
+	return token.Error()
+}
+
+// Subscribe listens on another topic for as long as we're connected. Call
+// it from an OnConnect hook so it's redone after reconnecting.
+func (l *MQTTListener) Subscribe(topic string, handler func(payload []byte)) error {
+	l.lock.Lock()
+	client, qos := l.client, l.QoS
+	l.lock.Unlock()
+	if client == nil || !client.IsConnectionOpen() {
+		return errNotConnected
+	}
+	token := client.Subscribe(topic, byte(qos), func(c MQTT.Client, m MQTT.Message) {
+		handler(m.Payload())
+	})
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("timed out subscribing to %s", topic)
+	}
+	return token.Error()
+}
+
+// Unsubscribe stops listening on a topic from Subscribe
+func (l *MQTTListener) Unsubscribe(topic string) error {
+	l.lock.Lock()
+	client := l.client
+	l.lock.Unlock()
+	if client == nil || !client.IsConnectionOpen() {
+		return errNotConnected
+	}
+	token := client.Unsubscribe(topic)
+	if !token.WaitTimeout(10 * time.Second) {
+		return fmt.Errorf("timed out unsubscribing from %s", topic)
+	}
+	return token.Error()
+}
+
+// StateTopic is where StatePublisher publishes, without any trailing /
+func (cfg MQTTConfig) StateTopic() string {
+	return strings.TrimSuffix(cfg.PublishTopic, "/")
+}
+
+// AvailabilityTopic is where we say whether we're online, if we're
+// publishing at all
+func (cfg MQTTConfig) AvailabilityTopic() string {
+	if cfg.PublishTopic == "" {
+		return ""
+	}
+	return cfg.StateTopic() + "/availability"
+}
+
+// subscribe subscribes to the topic, retrying until it works, the
+// connection goes away or ctx is done
+func (l *MQTTListener) subscribe(ctx context.Context, c MQTT.Client) {
+	backoff := minBackoff
+	for {
+		l.lock.Lock()
+		topic, qos := l.Topic, l.QoS
+		l.lock.Unlock()
+
+		token := c.Subscribe(topic, byte(qos), l.onMessageReceived)
+		token.Wait()
+		if token.Error() == nil {
+			l.lock.Lock()
+			l.subscribed = true
+			l.lock.Unlock()
+			return
+		}
+		log.Printf("Failed to subscribe to %s: %v. Trying again in %s\n", topic, token.Error(), backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if !c.IsConnectionOpen() {
+			return
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
 
-	// payload is in the format: 1577640142,163.4
-	payload := message.Payload()
-	parts := strings.Split(string(payload), ",")
-	weight := l.parseWeight(parts[1])
+// disconnected records that we've lost (or haven't yet got) the connection
+func (l *MQTTListener) disconnected(err error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.connected = false
+	l.subscribed = false
+	if l.downSince.IsZero() {
+		l.downSince = time.Now()
+	}
+	if err != nil {
+		l.lastError = err
+	}
+}
 
-	l.Datastore.Set(
-		weight,
-		l.niceDate(parts[0]),
-		cylinder.CalcRemaining(weight),
-	)
+// Down says whether we're not connected to the broker, since when, and
+// the last thing that went wrong
+func (l *MQTTListener) Down() (bool, time.Time, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return !l.connected, l.downSince, l.lastError
 }
 
 // Initialize and start the MQTTListener
 func (l *MQTTListener) Run(ctx context.Context) func() error {
 	return func() error {
-		hostname, _ := os.Hostname()
-		qos := 0
-		clientid := hostname
+		for {
+			restarted, err := l.runClient(ctx)
+			if !restarted {
+				return err
+			}
+			log.Println("MQTT server changed, reconnecting")
+		}
+	}
+}
 
-		connOpts := MQTT.NewClientOptions().AddBroker(l.Server).SetClientID(clientid).SetCleanSession(true)
+// runClient connects to the server and listens until we're shutting down
+// or the server changes, in which case it returns true
+func (l *MQTTListener) runClient(ctx context.Context) (bool, error) {
+	l.lock.Lock()
+	if l.restart == nil {
+		l.restart = make(chan struct{}, 1)
+	}
+	restart := l.restart
+	cfg := l.MQTTConfig
+	l.lock.Unlock()
+	server := cfg.Server
+	// Stops anything still going on this connection (like retrying the
+	// subscribe) once we're done with it
+	clientCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		connOpts.OnConnect = func(c MQTT.Client) {
-			if token := c.Subscribe(l.Topic, byte(qos), l.onMessageReceived); token.Wait() && token.Error() != nil {
-				panic(token.Error())
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		return false, err
+	}
+	connOpts := MQTT.NewClientOptions().
+		AddBroker(server).
+		SetClientID(cfg.ClientIDOrDefault()).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetCleanSession(cfg.CleanSession).
+		// With a persistent session the broker can start sending what it
+		// held on to before we've resubscribed
+		SetDefaultPublishHandler(func(c MQTT.Client, m MQTT.Message) {
+			l.lock.Lock()
+			topic := l.Topic
+			l.lock.Unlock()
+			if m.Topic() == topic {
+				l.onMessageReceived(c, m)
 			}
+		})
+	if tlsConfig != nil {
+		connOpts.SetTLSConfig(tlsConfig)
+	}
+	// If we're publishing, let everyone know whether we're around. The
+	// broker says we're offline for us if we drop off without saying.
+	availability := cfg.AvailabilityTopic()
+	if availability != "" {
+		connOpts.SetWill(availability, "offline", byte(cfg.QoS), true)
+	}
+
+	// paho reconnects on its own once we've connected the first time,
+	// these keep track of it and resubscribe each time it's back
+	connOpts.SetMaxReconnectInterval(maxBackoff)
+	connOpts.OnConnect = func(c MQTT.Client) {
+		l.lock.Lock()
+		l.connected = true
+		l.downSince = time.Time{}
+		l.lastError = nil
+		l.lock.Unlock()
+		log.Printf("Connected to %s\n", server)
+		if availability != "" {
+			c.Publish(availability, byte(cfg.QoS), true, "online")
 		}
+		l.subscribe(clientCtx, c)
 
-		client := MQTT.NewClient(connOpts)
-		if token := client.Connect(); token.Wait() && token.Error() != nil {
-			panic(token.Error())
-		} else {
-			log.Printf("Connected to %s\n", l.Server)
+		l.lock.Lock()
+		hooks := slices.Clone(l.onConnect)
+		l.lock.Unlock()
+		for _, hook := range hooks {
+			hook()
 		}
+	}
+	connOpts.OnConnectionLost = func(c MQTT.Client, err error) {
+		log.Printf("Lost the connection to %s: %v\n", server, err)
+		l.disconnected(err)
+	}
+	connOpts.OnReconnecting = func(c MQTT.Client, opts *MQTT.ClientOptions) {
+		log.Printf("Trying to reconnect to %s\n", server)
+	}
 
-		<-ctx.Done()
-		log.Printf("MQTT received Done with Error %q. Shutting down.\n", ctx.Err().Error())
+	l.disconnected(nil)
+	client := MQTT.NewClient(connOpts)
+	l.lock.Lock()
+	l.client = client
+	l.lock.Unlock()
+	defer func() {
+		cancel()
+		l.lock.Lock()
+		l.client = nil
+		l.connected = false
+		l.subscribed = false
+		l.lock.Unlock()
+		if availability != "" && client.IsConnectionOpen() {
+			client.Publish(availability, byte(cfg.QoS), true, "offline").WaitTimeout(time.Second)
+		}
+		client.Disconnect(250)
+	}()
 
-		return nil
+	// Keep trying until the first connect works. After that, paho takes
+	// care of reconnecting.
+	backoff := minBackoff
+	for {
+		token := client.Connect()
+		select {
+		case <-token.Done():
+		case <-ctx.Done():
+			return false, nil
+		case <-restart:
+			return true, nil
+		}
+		if token.Error() == nil {
+			break
+		}
+		log.Printf("Couldn't connect to %s: %v. Trying again in %s\n", server, token.Error(), backoff)
+		l.disconnected(token.Error())
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return false, nil
+		case <-restart:
+			return true, nil
+		}
+		backoff = min(backoff*2, maxBackoff)
 	}
-}
\ No newline at end of file
+
+	select {
+	case <-ctx.Done():
+		log.Printf("MQTT received Done with Error %q. Shutting down.\n", ctx.Err().Error())
+		return false, nil
+	case <-restart:
+		return true, nil
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+// fakeMessage is an MQTT message that didn't come from a broker
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m fakeMessage) Duplicate() bool   { return false }
+func (m fakeMessage) Qos() byte         { return 1 }
+func (m fakeMessage) Retained() bool    { return false }
+func (m fakeMessage) Topic() string     { return m.topic }
+func (m fakeMessage) MessageID() uint16 { return 1 }
+func (m fakeMessage) Payload() []byte   { return m.payload }
+func (m fakeMessage) Ack()              {}
+
+func TestMQTTMessages(t *testing.T) {
+	ingest, ds := newTestIngester(t)
+	l := &MQTTListener{Ingest: ingest, MQTTConfig: MQTTConfig{Topic: "propane/weight"}}
+	ts := Now().Add(-time.Minute).Truncate(time.Second)
+
+	l.onMessageReceived(nil, fakeMessage{"propane/weight", fmt.Appendf(nil, "%d,135.0", ts.Unix())})
+	if got := ds.Get(); got.Weight != 135 || got.Remaining != 75 || !got.TimeStamp.Equal(ts) {
+		t.Errorf("after a reading the datastore has %+v, want 135 lbs at 75%% from %s", got, ts)
+	}
+	l.lock.Lock()
+	heard := !l.lastMessage.IsZero()
+	l.lock.Unlock()
+	if !heard {
+		t.Errorf("the listener didn't note when the last message came in")
+	}
+
+	// Junk shouldn't replace a good reading
+	for _, payload := range []string{"", "hello", "1577640142,", `{"weight": -5}`} {
+		l.onMessageReceived(nil, fakeMessage{"propane/weight", []byte(payload)})
+	}
+	if got := ds.Get(); got.Weight != 135 {
+		t.Errorf("junk payloads changed the datastore to %+v", got)
+	}
+}
+
+// failedToken is an MQTT token for something that's already failed
+type failedToken struct{}
+
+func (failedToken) Wait() bool                     { return true }
+func (failedToken) WaitTimeout(time.Duration) bool { return true }
+func (failedToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (failedToken) Error() error { return errors.New("not authorized") }
+
+// refusingClient is connected, but won't let us subscribe to anything
+type refusingClient struct{ MQTT.Client }
+
+func (refusingClient) Subscribe(string, byte, MQTT.MessageHandler) MQTT.Token { return failedToken{} }
+func (refusingClient) IsConnectionOpen() bool                                 { return true }
+
+// Shutting down (or reconnecting) doesn't have to wait for subscribe to
+// give up
+func TestMQTTSubscribeStops(t *testing.T) {
+	l := &MQTTListener{MQTTConfig: MQTTConfig{Topic: "propane/weight"}}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.subscribe(ctx, refusingClient{})
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(minBackoff / 2):
+		t.Fatal("subscribe kept retrying after we stopped")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Tracks getting a new cylinder from "we need one" through to "it's
+// hooked up", so we don't have to keep a spreadsheet of who ordered
+// what from where and what it cost. Kept in orders.json.
+
+const ordersFile = "orders.json"
+
+type OrderState string
+
+const (
+	OrderNeeded    OrderState = "needed"
+	OrderOrdered   OrderState = "ordered"
+	OrderDelivered OrderState = "delivered"
+	OrderInstalled OrderState = "installed"
+	OrderCancelled OrderState = "cancelled"
+)
+
+// The order states in the order they happen
+var orderStates = []OrderState{OrderNeeded, OrderOrdered, OrderDelivered, OrderInstalled}
+
+func ParseOrderState(s string) (OrderState, error) {
+	for _, st := range append(slices.Clone(orderStates), OrderCancelled) {
+		if string(st) == s {
+			return st, nil
+		}
+	}
+	return "", errors.New("unknown order state " + s)
+}
+
+// An order is finished once it's installed or cancelled
+func (s OrderState) Closed() bool {
+	return s == OrderInstalled || s == OrderCancelled
+}
+
+type Order struct {
+	ID    int        `json:"id"`
+	State OrderState `json:"state"`
+	// When the order entered each state
+	NeededAt    time.Time `json:"neededAt,omitzero"`
+	OrderedAt   time.Time `json:"orderedAt,omitzero"`
+	DeliveredAt time.Time `json:"deliveredAt,omitzero"`
+	InstalledAt time.Time `json:"installedAt,omitzero"`
+	CancelledAt time.Time `json:"cancelledAt,omitzero"`
+	// Who placed the order (Discord user ID, if it came from Discord, and name)
+	OrderedBy        string    `json:"orderedBy,omitempty"`
+	OrderedByName    string    `json:"orderedByName,omitempty"`
+	Supplier         string    `json:"supplier,omitempty"`
+	ExpectedDelivery time.Time `json:"expectedDelivery,omitzero"`
+	Cost             float64   `json:"cost,omitempty"`
+}
+
+// Describe gives a one-line summary of the order for the bot and web page
+func (o Order) Describe() string {
+	desc := fmt.Sprintf("Order #%d is %s", o.ID, o.State)
+	if o.OrderedByName != "" {
+		desc += ", ordered by " + o.OrderedByName
+	}
+	if o.Supplier != "" {
+		desc += " from " + o.Supplier
+	}
+	if o.Cost != 0 {
+		desc += fmt.Sprintf(" for $%.2f", o.Cost)
+	}
+	if !o.ExpectedDelivery.IsZero() && (o.State == OrderOrdered || o.State == OrderNeeded) {
+		desc += ", expected " + o.ExpectedDelivery.Format("Mon Jan _2")
+	}
+	return desc
+}
+
+// The optional details that can be filled in as an order moves along.
+// Anything left empty keeps its current value.
+type OrderDetails struct {
+	OrderedBy        string
+	OrderedByName    string
+	Supplier         string
+	ExpectedDelivery time.Time
+	Cost             float64
+}
+
+type OrderStore struct {
+	path string
+	data struct {
+		NextID int     `json:"nextId"`
+		Orders []Order `json:"orders"`
+	}
+	lock sync.RWMutex
+}
+
+// NewOrderStore loads the orders kept at path
+func NewOrderStore(path string) *OrderStore {
+	s := &OrderStore{path: path}
+	s.data.NextID = 1
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to read orders: %s\n", err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(data, &s.data); err != nil {
+		log.Printf("Failed to parse orders: %s\n", err)
+	}
+	return s
+}
+
+// Current returns the order that's still in progress, if there is one
+func (s *OrderStore) Current() (Order, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if o := s.current(); o != nil {
+		return *o, true
+	}
+	return Order{}, false
+}
+
+// All returns every order, most recent first
+func (s *OrderStore) All() []Order {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	orders := slices.Clone(s.data.Orders)
+	slices.Reverse(orders)
+	return orders
+}
+
+// Advance moves the current order to the given state, filling in any
+// details given. Marking a cylinder as needed or ordered starts a new order
+// if there isn't one in progress; anything else needs an order to work on.
+// Orders can skip states but never go backwards.
+func (s *OrderStore) Advance(to OrderState, now time.Time, details OrderDetails) (Order, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	o := s.current()
+	if o == nil {
+		if to != OrderNeeded && to != OrderOrdered {
+			return Order{}, errors.New("there's no order in progress")
+		}
+		s.data.Orders = append(s.data.Orders, Order{ID: s.data.NextID, State: OrderNeeded, NeededAt: now})
+		s.data.NextID++
+		o = &s.data.Orders[len(s.data.Orders)-1]
+	} else if to != OrderCancelled && slices.Index(orderStates, to) < slices.Index(orderStates, o.State) {
+		return *o, fmt.Errorf("order #%d is already %s", o.ID, o.State)
+	}
+
+	o.State = to
+	switch to {
+	case OrderOrdered:
+		o.OrderedAt = now
+	case OrderDelivered:
+		o.DeliveredAt = now
+	case OrderInstalled:
+		o.InstalledAt = now
+	case OrderCancelled:
+		o.CancelledAt = now
+	}
+
+	if details.OrderedBy != "" {
+		o.OrderedBy = details.OrderedBy
+	}
+	if details.OrderedByName != "" {
+		o.OrderedByName = details.OrderedByName
+	}
+	if details.Supplier != "" {
+		o.Supplier = details.Supplier
+	}
+	if !details.ExpectedDelivery.IsZero() {
+		o.ExpectedDelivery = details.ExpectedDelivery
+	}
+	if details.Cost != 0 {
+		o.Cost = details.Cost
+	}
+
+	return *o, s.save()
+}
+
+// Must be called with the lock held
+func (s *OrderStore) current() *Order {
+	if n := len(s.data.Orders); n > 0 && !s.data.Orders[n-1].State.Closed() {
+		return &s.data.Orders[n-1]
+	}
+	return nil
+}
+
+// Must be called with the lock held
+func (s *OrderStore) save() error {
+	data, err := json.MarshalIndent(s.data, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0644)
+}
@@ -2,94 +2,273 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
-	"time"
-
-	"golang.org/x/sync/errgroup"
+	// So timezones work even where the system has no tzdata
+	_ "time/tzdata"
 )
 
-// func getenv(name string) string {
-// 	v := os.Getenv(name)
-// 	if v == "" {
-// 		panic("missing required environment variable " + name)
-// 	}
-// 	return v
-// }
-
-type AppConfig struct {
-	MQTT struct {
-		Server string `json:"server"`
-		Topic  string `json:"topic"`
-	} `json:"mqtt"`
-	Discord struct {
-		AppToken  string `json:"appToken"`
-		GuildID   string `json:"guildId"`
-		BotToken  string `json:"botToken"`
-		ChannelID string `json:"channelId"`
-		UserID    string `json:"userId"`
-	} `json:"discord"`
-	Slack struct {
-		APIToken string `json:"apiToken"`
-	} `json:"slack"`
-}
+func main() {
+	configPath := flag.String("config", os.Getenv(envPrefix+"_CONFIG"), "path to the config file (default ./config.json)")
+	cylinderPath := flag.String("cylinder", os.Getenv(envPrefix+"_CYLINDER"), "path to the cylinder settings (default ./"+cylinderFile+")")
+	checkConfig := flag.Bool("check-config", false, "check the config for problems and exit")
+	simulate := flag.String("simulate", "", "feed in readings from a recording, or \"synthetic\" ones, instead of the scale")
+	speed := flag.Float64("speed", 60, "how much faster than real time to run when simulating")
+	seed := flag.Uint64("seed", 1, "random seed for synthetic readings")
+	flag.Parse()
 
-func LoadConfig(path string, cfg *AppConfig) error {
-	f, err := os.Open(path)
-	if err != nil {
-		return err
+	// Simulations get their own subscriptions, alerts etc. so they don't
+	// mess with the real ones
+	stateFile := func(name string) string {
+		if *simulate != "" {
+			return "simulate-" + name
+		}
+		return name
+	}
+	// Nor do they listen to the real scale, whatever the config says (now
+	// or after it's reloaded)
+	var override func(*AppConfig)
+	if *simulate != "" {
+		override = simulateConfig
 	}
-	defer f.Close()
-	return json.NewDecoder(f).Decode(cfg)
-}
 
-func main() {
-	// Let's begin by reading the cylinder settings
-	LoadCylinderData()
+	// Defaults, then the config file, then the environment. The config
+	// file is optional unless one was asked for, since everything can
+	// come from the environment instead.
+	path := *configPath
+	if path == "" {
+		path = "./config.json"
+	}
+	cfg, err := BuildConfig(path, *configPath != "", override)
+	if err != nil {
+		log.Printf("There are problems with the config:\n  - %s\n", strings.ReplaceAll(err.Error(), "\n", "\n  - "))
+		os.Exit(1)
+	}
+	if err := SetDisplayConfig(cfg.Display); err != nil {
+		log.Printf("Failed to set the display timezone: %v\n", err)
+	}
+	// Before loading anything else, which has nothing to do with
+	// whether the config is any good
+	if *checkConfig {
+		log.Println("Config looks good!")
+		return
+	}
 
-	ds := NewDatastore()
-	var cfg AppConfig
-	if err := LoadConfig("./config.json", &cfg); err != nil {
-		panic("Failed to load config: " + err.Error())
+	// Now read the cylinder settings
+	if *cylinderPath == "" {
+		*cylinderPath = cylinderFile
 	}
+	cyl := NewCylinderStore(*cylinderPath)
+
+	// The datastore keeps the weight and works out the percent remaining
+	// from whatever the cylinder settings are now, so when they change
+	// everyone watching it should hear about the new percentage
+	ds := NewDatastore(cyl)
+	cyl.OnChange(ds.Refresh)
+	subs := NewSubscriptionStore(stateFile(subscriptionsFile))
+	alerts := NewAlertStore(stateFile(alertsFile))
+	orders := NewOrderStore(stateFile(ordersFile))
+	history := NewConsumptionHistory(stateFile(historyFile), ds, cyl)
+	calibration := NewCalibrationStore(stateFile(calibrationFile))
+	calibration.SetReminder(cfg.Alerts.CalibrationMonths)
+
 	// Get a Context that can handle stopping for signals, timeouts, or whatever else we throw at it
 	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer done()
-	wg, ctx := errgroup.WithContext(ctx)
+	// Each part gets restarted on its own if it fails, so Discord being
+	// down doesn't stop the web page from working (and so on)
+	sup, ctx := NewSupervisor(ctx)
 
 	// Watch cylinder.json so edits (including from the web settings page)
 	// are picked up without restarting the bot
-	wg.Go(WatchCylinderData(ctx))
+	sup.Go("cylinder", cyl.Watch(ctx))
+	sup.Check("cylinder", cyl.Health)
+
+	// Keep track of how fast we're using gas so we can tell when to order
+	sup.Go("history", history.Run(ctx))
+
+	// Readings come in over MQTT and/or HTTP, and both go through here
+	// (corrected for the scale drifting on the way)
+	ingest := &Ingester{Datastore: ds, Calibration: calibration}
+	calibration.OnChange(ingest.Recalibrate)
+
+	// Or from the simulator, which also speeds the clock up
+	if *simulate != "" {
+		sim, err := NewSimulator(ingest, cyl, *simulate, *speed, *seed)
+		if err != nil {
+			log.Printf("Can't simulate: %v\n", err)
+			os.Exit(1)
+		}
+		SetClock(sim.Clock)
+		log.Printf("Simulating at %gx speed, starting %s\n", *speed, FormatTime(Now()))
+		sup.Go("simulator", sim.Run(ctx))
+	}
+
+	// Maybe run our own MQTT broker for the scale to publish to
+	broker := &Broker{BrokerConfig: cfg.Broker}
+	if cfg.Broker.Enabled {
+		sup.Go("broker", broker.Run(ctx))
+		sup.Check("broker", broker.Health)
+	} else {
+		sup.Disabled("broker")
+	}
 
 	// Now start the mqtt stuff so we can start getting messages
-	wg.Go((&MQTTListener{
+	listener := &MQTTListener{
+		Ingest:     ingest,
+		MQTTConfig: cfg.MQTT,
+	}
+	if cfg.MQTT.Enabled {
+		sup.Go("mqtt", listener.Run(ctx))
+		sup.Check("mqtt", listener.Health)
+	} else {
+		sup.Disabled("mqtt")
+	}
+
+	// Or straight from a scale plugged into the Pi
+	scale := &SerialReader{
+		Ingest:       ingest,
+		SerialConfig: cfg.Serial,
+	}
+	if cfg.Serial.Enabled {
+		sup.Go("serial", scale.Run(ctx))
+		sup.Check("serial", scale.Health)
+	} else {
+		sup.Disabled("serial")
+	}
+
+	// Publish what we've worked out back to MQTT for other things to use
+	publisher := &StatePublisher{
+		MQTT:      listener,
+		Topic:     cfg.MQTT.StateTopic(),
 		Datastore: ds,
-		Server:    cfg.MQTT.Server,
-		Topic:     cfg.MQTT.Topic,
-	}).Run(ctx))
+		Alerts:    alerts,
+		History:   history,
+	}
+	if cfg.MQTT.Enabled && cfg.MQTT.PublishTopic != "" {
+		listener.OnConnect(publisher.Republish)
+		sup.Go("publisher", publisher.Run(ctx))
+	} else {
+		sup.Disabled("publisher")
+	}
+
+	// And tell Home Assistant about the tank, using what the publisher
+	// publishes, while it's turned on (which can change without a restart)
+	ha := &HomeAssistant{
+		MQTT:              listener,
+		Enabled:           cfg.HomeAssistant.Enabled,
+		DiscoveryPrefix:   cfg.HomeAssistant.DiscoveryPrefix,
+		NodeID:            cfg.HomeAssistant.NodeID,
+		StateTopic:        cfg.MQTT.StateTopic(),
+		AvailabilityTopic: cfg.MQTT.AvailabilityTopic(),
+	}
+	listener.OnConnect(ha.OnConnect)
 
 	// Setup and run Discord
-	dc := &DiscordBot{AppToken: cfg.Discord.AppToken,
-		GuildID:   cfg.Discord.GuildID,
-		BotToken:  cfg.Discord.BotToken,
-		ChannelID: cfg.Discord.ChannelID,
-		UserID:    cfg.Discord.UserID,
-		Datastore: ds}
-	wg.Go(dc.Run(ctx))
+	var dc *DiscordBot
+	if cfg.Discord.Enabled {
+		dc = &DiscordBot{AppToken: cfg.Discord.AppToken,
+			GuildID:       cfg.Discord.GuildID,
+			BotToken:      cfg.Discord.BotToken,
+			ChannelID:     cfg.Discord.ChannelID,
+			UserID:        cfg.Discord.UserID,
+			Datastore:     ds,
+			Subscriptions: subs,
+			Alerts:        alerts,
+			Orders:        orders,
+			History:       history}
+		sup.Go("discord", dc.Run(ctx))
+		sup.Check("discord", dc.Health)
+	} else {
+		sup.Disabled("discord")
+	}
 
 	// Setup and run the propane monitor that will send alerts to Discord when the level is low
-	monitor := NewPropaneMonitor(dc, ds, 10*time.Second)
-	go monitor.Start(ctx)
+	monitor := NewPropaneMonitor(ds, subs, alerts, orders, history, cfg.Monitor.Interval.Duration)
+	monitor.SetAlertConfig(cfg.Alerts)
+	if dc != nil {
+		monitor.AddNotifier(dc)
+	}
+	if cfg.MQTT.Enabled {
+		monitor.WatchBroker(listener)
+	}
+	monitor.WatchCalibration(calibration)
+	if cfg.Monitor.Enabled {
+		sup.Go("monitor", func() error {
+			monitor.Start(ctx)
+			return nil
+		})
+	} else {
+		sup.Disabled("monitor")
+	}
 
-	// Start the web server on port 9991
-	wg.Go((&WebServer{
-		Port:      9991,
-		Datastore: ds,
-	}).Run(ctx))
+	// Start the web server (on port 9991 unless configured otherwise)
+	web := &WebServer{
+		Port:        cfg.Web.Port,
+		IngestToken: cfg.Web.IngestToken,
+		Ingest:      ingest,
+		Datastore:   ds,
+		Cylinder:    cyl,
+		Calibration: calibration,
+		Orders:      orders,
+		History:     history,
+		Health:      sup,
+	}
+	if cfg.Web.Enabled {
+		sup.Go("web", web.Run(ctx))
+	} else {
+		sup.Disabled("web")
+	}
+
+	// Watch the config file too, and hand any changes to whatever they
+	// affect. Each of these only reconnects/restarts if it has to.
+	sup.Go("config", WatchConfig(ctx, path, cfg, override, func(old, new AppConfig) {
+		if new.MQTT.Enabled != old.MQTT.Enabled || new.Serial.Enabled != old.Serial.Enabled || new.Discord.Enabled != old.Discord.Enabled ||
+			new.Web.Enabled != old.Web.Enabled ||
+			new.Monitor.Enabled != old.Monitor.Enabled ||
+			(new.MQTT.PublishTopic == "") != (old.MQTT.PublishTopic == "") {
+			log.Println("Turning things on or off needs a restart to take effect")
+		}
+		if new.Broker != old.Broker {
+			log.Println("Changes to the built-in broker need a restart to take effect")
+		}
+		if new.Display != old.Display {
+			if err := SetDisplayConfig(new.Display); err != nil {
+				log.Printf("Failed to set the display timezone: %v\n", err)
+			}
+		}
+		monitor.SetAlertConfig(new.Alerts)
+		calibration.SetReminder(new.Alerts.CalibrationMonths)
+		if new.Monitor.Interval != old.Monitor.Interval {
+			monitor.SetInterval(new.Monitor.Interval.Duration)
+		}
+		if dc != nil && new.Discord != old.Discord {
+			dc.Reconfigure(new.Discord)
+		}
+		if new.MQTT != old.MQTT {
+			listener.Reconfigure(new.MQTT)
+		}
+		if new.Serial != old.Serial {
+			scale.Reconfigure(new.Serial)
+		}
+		if new.MQTT.PublishTopic != old.MQTT.PublishTopic {
+			publisher.SetTopic(new.MQTT.StateTopic())
+		}
+		if new.HomeAssistant != old.HomeAssistant || (new.HomeAssistant.Enabled && new.MQTT.PublishTopic != old.MQTT.PublishTopic) {
+			ha.Reconfigure(new.HomeAssistant, new.MQTT)
+		}
+		if new.Web.Port != old.Web.Port {
+			web.SetPort(new.Web.Port)
+		}
+		if new.Web.IngestToken != old.Web.IngestToken {
+			web.SetIngestToken(new.Web.IngestToken)
+		}
+	}))
 
 	// Wait for exit and print any error messages that bubble up
-	log.Printf("Exiting with message: %q\n", wg.Wait())
+	log.Printf("Exiting with message: %q\n", sup.Wait())
 }
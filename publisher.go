@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// Publishes what the bot has worked out (percent remaining, the forecast,
+// which alerts are going off) back to MQTT as retained messages, so other
+// things in the space (Node-RED, the door display...) can use it without
+// doing the math themselves. With mqtt.publishTopic set to propane/state
+// you get:
+//
+//	propane/state/remaining  {"weight":140,"remaining":74,"state":"ok","timestamp":"..."}
+//	propane/state/forecast   {"lbsPerDay":1.5,"daysRemaining":49}
+//	propane/state/alerts     {"active":["low"],"alerts":[...]}
+//	propane/state/stale      {"stale":false,"lastReading":"..."}
+//
+// The MQTT listener also keeps propane/state/availability set to online
+// or offline.
+
+// How often to check whether the scale has gone quiet, since there's no
+// reading to tell us when it does
+const staleCheckEvery = time.Minute
+
+// MQTTPublisher is somewhere to publish to (that's MQTTListener)
+type MQTTPublisher interface {
+	Publish(topic string, retained bool, payload []byte) error
+}
+
+type StatePublisher struct {
+	MQTT MQTTPublisher
+	// Topics go under this one
+	Topic     string
+	Datastore ReadingSource
+	Alerts    *AlertStore
+	History   *ConsumptionHistory
+	// How long the scale can go quiet before it's stale, the same as the
+	// stale alert unless set
+	StaleAfter time.Duration
+	// Guards Topic, which can change when config.json does
+	lock sync.Mutex
+	// Tells Run to publish everything again
+	republish chan struct{}
+	// When Run started, for going stale without ever getting a reading
+	started time.Time
+	// What was last published to stale
+	stale bool
+}
+
+// SetTopic moves where everything gets published to
+func (p *StatePublisher) SetTopic(topic string) {
+	p.lock.Lock()
+	p.Topic = topic
+	p.lock.Unlock()
+	p.Republish()
+}
+
+// Republish publishes everything again, e.g. after reconnecting to a
+// broker that might have forgotten the retained messages
+func (p *StatePublisher) Republish() {
+	select {
+	case p.republishChan() <- struct{}{}:
+	default:
+	}
+}
+
+func (p *StatePublisher) republishChan() chan struct{} {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.republish == nil {
+		p.republish = make(chan struct{}, 1)
+	}
+	return p.republish
+}
+
+// Run publishes new readings and alert changes as they happen
+func (p *StatePublisher) Run(ctx context.Context) func() error {
+	return func() error {
+		readings, stopReadings := p.Datastore.Watch()
+		defer stopReadings()
+		alerts, stopAlerts := p.Alerts.Watch()
+		defer stopAlerts()
+		republish := p.republishChan()
+		ticker := time.NewTicker(staleCheckEvery)
+		defer ticker.Stop()
+
+		p.started = Now()
+		p.publishAll(Now())
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case data := <-readings:
+				p.publishReading(data)
+				p.publishForecast()
+				p.publishStale(Now())
+			case active := <-alerts:
+				p.publishAlerts(active)
+			case <-ticker.C:
+				p.checkStale(Now())
+			case <-republish:
+				p.publishAll(Now())
+			}
+		}
+	}
+}
+
+func (p *StatePublisher) publishAll(now time.Time) {
+	data := p.Datastore.Get()
+	if !data.TimeStamp.IsZero() {
+		p.publishReading(data)
+	}
+	p.publishForecast()
+	p.publishAlerts(p.Alerts.ActiveAlerts())
+	p.publishStale(now)
+}
+
+func (p *StatePublisher) publishReading(data CurrentData) {
+	p.publish("remaining", struct {
+		Weight float64 `json:"weight"`
+		// null with no cylinder on the scale
+		Remaining *float64  `json:"remaining"`
+		State     TankState `json:"state"`
+		TimeStamp time.Time `json:"timestamp"`
+	}{data.Weight, data.remaining(), data.State, data.TimeStamp})
+}
+
+func (p *StatePublisher) publishForecast() {
+	var forecast struct {
+		LbsPerDay     *float64 `json:"lbsPerDay"`
+		DaysRemaining *float64 `json:"daysRemaining"`
+	}
+	if f, ok := p.History.Forecast(); ok {
+		forecast.LbsPerDay = &f.LbsPerDay
+		forecast.DaysRemaining = &f.DaysRemaining
+	}
+	p.publish("forecast", forecast)
+}
+
+func (p *StatePublisher) publishAlerts(active []Alert) {
+	levels := []AlertLevel{}
+	for _, a := range active {
+		levels = append(levels, a.Level)
+	}
+	if active == nil {
+		active = []Alert{}
+	}
+	p.publish("alerts", struct {
+		Active []AlertLevel `json:"active"`
+		Alerts []Alert      `json:"alerts"`
+	}{levels, active})
+}
+
+// isStale works out whether the scale has gone quiet from when we last
+// heard from it, rather than from the stale alert, which only goes off if
+// it can be posted somewhere (and the monitor is turned on)
+func (p *StatePublisher) isStale(now time.Time) bool {
+	staleAfter := p.StaleAfter
+	if staleAfter <= 0 {
+		staleAfter = defaultStaleAfter
+	}
+	// Until the first reading arrives, count from when we started
+	lastHeard := p.Datastore.Get().TimeStamp
+	if lastHeard.IsZero() {
+		lastHeard = p.started
+	}
+	return now.Sub(lastHeard) > staleAfter
+}
+
+func (p *StatePublisher) publishStale(now time.Time) {
+	p.stale = p.isStale(now)
+	p.publish("stale", struct {
+		Stale       bool      `json:"stale"`
+		LastReading time.Time `json:"lastReading,omitzero"`
+	}{p.stale, p.Datastore.Get().TimeStamp})
+}
+
+// checkStale publishes stale again if it's changed
+func (p *StatePublisher) checkStale(now time.Time) {
+	if p.isStale(now) != p.stale {
+		p.publishStale(now)
+	}
+}
+
+// publish sends v as JSON to the given topic under ours, as a retained
+// message so anyone subscribing later gets the latest right away
+func (p *StatePublisher) publish(subtopic string, v any) {
+	p.lock.Lock()
+	topic := p.Topic + "/" + subtopic
+	p.lock.Unlock()
+
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode %s: %v\n", topic, err)
+		return
+	}
+	// Not being connected is already logged (and on /readyz), and we'll
+	// publish everything again when we are
+	if err := p.MQTT.Publish(topic, true, payload); err != nil && !errors.Is(err, errNotConnected) {
+		log.Printf("Failed to publish %s: %v\n", topic, err)
+	}
+}
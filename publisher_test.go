@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMQTT remembers what was published to each topic, instead of
+// publishing it, and what's been subscribed to
+type fakeMQTT struct {
+	lock          sync.Mutex
+	messages      map[string][][]byte
+	subscriptions map[string]func(payload []byte)
+}
+
+func (m *fakeMQTT) Subscribe(topic string, handler func(payload []byte)) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.subscriptions == nil {
+		m.subscriptions = map[string]func(payload []byte){}
+	}
+	m.subscriptions[topic] = handler
+	return nil
+}
+
+func (m *fakeMQTT) Unsubscribe(topic string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.subscriptions, topic)
+	return nil
+}
+
+// subscribed lists the topics subscribed to
+func (m *fakeMQTT) subscribed() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return slices.Sorted(maps.Keys(m.subscriptions))
+}
+
+// last is the last thing published to topic, and whether anything was
+func (m *fakeMQTT) last(topic string) ([]byte, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	messages := m.messages[topic]
+	if len(messages) == 0 {
+		return nil, false
+	}
+	return messages[len(messages)-1], true
+}
+
+func (m *fakeMQTT) Publish(topic string, retained bool, payload []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.messages == nil {
+		m.messages = map[string][][]byte{}
+	}
+	m.messages[topic] = append(m.messages[topic], payload)
+	return nil
+}
+
+// latest decodes the last thing published to topic into v, and says how
+// many times it's been published to
+func (m *fakeMQTT) latest(t *testing.T, topic string, v any) int {
+	t.Helper()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	messages := m.messages[topic]
+	if len(messages) == 0 {
+		t.Fatalf("nothing was published to %s", topic)
+	}
+	if err := json.Unmarshal(messages[len(messages)-1], v); err != nil {
+		t.Fatal(err)
+	}
+	return len(messages)
+}
+
+func newTestPublisher(t *testing.T) (*StatePublisher, *fakeMQTT, *Datastore) {
+	t.Helper()
+	dir := t.TempDir()
+	cyl := newTestCylinderStore(t)
+	ds := NewDatastore(cyl)
+	mqtt := &fakeMQTT{}
+	p := &StatePublisher{
+		MQTT:      mqtt,
+		Topic:     "propane/state",
+		Datastore: ds,
+		Alerts:    NewAlertStore(filepath.Join(dir, alertsFile)),
+		History:   NewConsumptionHistory(filepath.Join(dir, historyFile), ds, cyl),
+		started:   monitorStart,
+	}
+	return p, mqtt, ds
+}
+
+func TestStatePublisherPublishAll(t *testing.T) {
+	p, mqtt, ds := newTestPublisher(t)
+	ds.Set(110, monitorStart)
+	if err := p.Alerts.Fire(AlertLow, monitorStart); err != nil {
+		t.Fatal(err)
+	}
+	p.publishAll(monitorStart.Add(time.Minute))
+
+	var remaining struct {
+		Weight    float64   `json:"weight"`
+		Remaining *float64  `json:"remaining"`
+		State     TankState `json:"state"`
+	}
+	mqtt.latest(t, "propane/state/remaining", &remaining)
+	if remaining.Weight != 110 || remaining.Remaining == nil || *remaining.Remaining != 50 || remaining.State != TankOK {
+		t.Errorf("remaining = %+v, want 110 lbs at 50%%", remaining)
+	}
+
+	var alerts struct {
+		Active []AlertLevel `json:"active"`
+	}
+	mqtt.latest(t, "propane/state/alerts", &alerts)
+	if !slices.Equal(alerts.Active, []AlertLevel{AlertLow}) {
+		t.Errorf("active alerts = %v, want just low", alerts.Active)
+	}
+
+	var forecast struct {
+		DaysRemaining *float64 `json:"daysRemaining"`
+	}
+	mqtt.latest(t, "propane/state/forecast", &forecast)
+	if forecast.DaysRemaining != nil {
+		t.Errorf("there isn't enough history for a forecast, got %v days", *forecast.DaysRemaining)
+	}
+}
+
+// The scale going quiet is stale whether or not the stale alert went out
+// (it won't have if the network is down too)
+func TestStatePublisherStale(t *testing.T) {
+	p, mqtt, ds := newTestPublisher(t)
+	var stale struct {
+		Stale       bool      `json:"stale"`
+		LastReading time.Time `json:"lastReading"`
+	}
+
+	// Not yet, with no readings since we started
+	p.publishAll(monitorStart.Add(time.Minute))
+	mqtt.latest(t, "propane/state/stale", &stale)
+	if stale.Stale {
+		t.Errorf("it shouldn't be stale a minute after starting")
+	}
+	p.checkStale(monitorStart.Add(31 * time.Minute))
+	mqtt.latest(t, "propane/state/stale", &stale)
+	if !stale.Stale {
+		t.Errorf("it should be stale with no readings for 31 minutes")
+	}
+
+	// A reading makes it fresh again
+	ds.Set(150, monitorStart.Add(40*time.Minute))
+	p.publishStale(monitorStart.Add(40 * time.Minute))
+	mqtt.latest(t, "propane/state/stale", &stale)
+	if stale.Stale || !stale.LastReading.Equal(monitorStart.Add(40*time.Minute)) {
+		t.Errorf("stale = %+v, want fresh as of the new reading", stale)
+	}
+
+	// Until it goes quiet, which is only published the once
+	p.checkStale(monitorStart.Add(50 * time.Minute))
+	p.checkStale(monitorStart.Add(71 * time.Minute))
+	n := mqtt.latest(t, "propane/state/stale", &stale)
+	if !stale.Stale {
+		t.Errorf("it should be stale 31 minutes after the last reading")
+	}
+	p.checkStale(monitorStart.Add(72 * time.Minute))
+	if got := mqtt.latest(t, "propane/state/stale", &stale); got != n {
+		t.Errorf("stale was published %d times, want %d (only when it changes)", got, n)
+	}
+}
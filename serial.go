@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// Reads weights straight from a scale's RS-232 output (through a USB
+// serial adapter on the Pi), or from any character device or pipe that
+// spits out a line per reading. Each line is matched against a regex to
+// pull the weight out, and the reading goes through the same Ingester as
+// MQTT and HTTP.
+
+// The first number on the line
+const defaultLineRegex = `([-+]?\d+(?:\.\d+)?)`
+
+type SerialReader struct {
+	Ingest *Ingester
+	SerialConfig
+	// Guards the settings, which can change when config.json does
+	lock sync.Mutex
+	// Tells Run to reopen the device with new settings
+	restart chan struct{}
+	// How the device is doing, for /readyz
+	open     bool
+	lastLine time.Time
+	lastRead time.Time
+}
+
+// Reconfigure applies new settings from config.json by reopening the
+// device
+func (s *SerialReader) Reconfigure(cfg SerialConfig) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.SerialConfig = cfg
+	if s.restart != nil {
+		select {
+		case s.restart <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Health is the health check for the serial reader: the device has to be
+// open. When we last got a line from it is there too.
+func (s *SerialReader) Health() (bool, any) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.open, struct {
+		Device      string    `json:"device"`
+		Open        bool      `json:"open"`
+		LastLine    time.Time `json:"lastLine,omitzero"`
+		LastReading time.Time `json:"lastReading,omitzero"`
+	}{s.Device, s.open, s.lastLine, s.lastRead}
+}
+
+func (s *SerialReader) Run(ctx context.Context) func() error {
+	return func() error {
+		for {
+			restarted, err := s.readDevice(ctx)
+			if !restarted {
+				return err
+			}
+			log.Println("Serial settings changed, reopening the device")
+		}
+	}
+}
+
+// readDevice reads lines until we're shutting down, the settings change
+// (in which case it returns true) or the device goes away
+func (s *SerialReader) readDevice(ctx context.Context) (bool, error) {
+	s.lock.Lock()
+	if s.restart == nil {
+		s.restart = make(chan struct{}, 1)
+	}
+	restart := s.restart
+	cfg := s.SerialConfig
+	s.lock.Unlock()
+
+	pattern, weightGroup, timestampGroup, err := cfg.Pattern()
+	if err != nil {
+		return false, err
+	}
+	device, err := cfg.open()
+	if err != nil {
+		return false, err
+	}
+	log.Printf("Reading the scale from %s\n", cfg.Device)
+
+	s.setOpen(true)
+	defer s.setOpen(false)
+
+	// Reading blocks, so the only way to stop is closing the device
+	restarted := make(chan bool, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			restarted <- false
+		case <-restart:
+			restarted <- true
+		case <-done:
+			return
+		}
+		device.Close()
+	}()
+
+	err = s.readLines(device, cfg, pattern, weightGroup, timestampGroup)
+
+	select {
+	case r := <-restarted:
+		return r, nil
+	default:
+	}
+	device.Close()
+	if err != nil {
+		return false, fmt.Errorf("reading %s: %w", cfg.Device, err)
+	}
+	return false, fmt.Errorf("%s closed", cfg.Device)
+}
+
+// readLines hands every reading on the device to the Ingester, until it's
+// closed
+func (s *SerialReader) readLines(device io.Reader, cfg SerialConfig, pattern *regexp.Regexp, weightGroup, timestampGroup int) error {
+	var lastSent time.Time
+	lines := bufio.NewScanner(device)
+	lines.Split(scanLines)
+	for lines.Scan() {
+		now := Now()
+		s.lock.Lock()
+		s.lastLine = now
+		s.lock.Unlock()
+
+		match := pattern.FindStringSubmatch(lines.Text())
+		if match == nil {
+			continue
+		}
+		// Scales can send several readings a second, we don't need them all
+		if now.Sub(lastSent) < cfg.Interval.Duration {
+			continue
+		}
+		reading, err := parseMatch(match, weightGroup, timestampGroup, now)
+		if err == nil {
+			err = s.Ingest.Store(reading)
+		}
+		if err != nil {
+			log.Printf("Ignoring reading %q from %s: %v\n", lines.Text(), cfg.Device, err)
+			continue
+		}
+		lastSent = now
+		s.lock.Lock()
+		s.lastRead = now
+		s.lock.Unlock()
+	}
+	return lines.Err()
+}
+
+// scanLines is bufio.ScanLines for scales that end lines with \r, \n or
+// \r\n (plenty only send \r). Blank lines are skipped, so \r\n doesn't
+// look like two lines, and a line doesn't have to wait for the next one to
+// find out whether a \n follows its \r.
+func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := 0
+	for start < len(data) && (data[start] == '\r' || data[start] == '\n') {
+		start++
+	}
+	if i := bytes.IndexAny(data[start:], "\r\n"); i >= 0 {
+		return start + i + 1, data[start : start+i], nil
+	}
+	if atEOF && start < len(data) {
+		return len(data), data[start:], nil
+	}
+	return start, nil, nil
+}
+
+func (s *SerialReader) setOpen(open bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.open = open
+}
+
+// Pattern compiles the line regex, and works out which groups have the
+// weight and (optionally) the timestamp in them
+func (cfg SerialConfig) Pattern() (pattern *regexp.Regexp, weight, timestamp int, err error) {
+	expr := cfg.LineRegex
+	if expr == "" {
+		expr = defaultLineRegex
+	}
+	pattern, err = regexp.Compile(expr)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	weight, timestamp = pattern.SubexpIndex("weight"), pattern.SubexpIndex("timestamp")
+	if weight < 0 {
+		if pattern.NumSubexp() == 0 {
+			return nil, 0, 0, errors.New("the line regex needs a group around the weight, e.g. (?P<weight>\\d+\\.\\d+)")
+		}
+		weight = 1
+	}
+	return pattern, weight, timestamp, nil
+}
+
+// open opens a serial port if there's a baud rate to set, otherwise it's
+// just a file (a pipe, a pseudo-terminal...)
+func (cfg SerialConfig) open() (io.ReadCloser, error) {
+	if cfg.BaudRate > 0 {
+		return serial.Open(cfg.Device, &serial.Mode{BaudRate: cfg.BaudRate})
+	}
+	return os.Open(cfg.Device)
+}
+
+func parseMatch(match []string, weightGroup, timestampGroup int, now time.Time) (Reading, error) {
+	weight, err := strconv.ParseFloat(match[weightGroup], 64)
+	if err != nil {
+		return Reading{}, fmt.Errorf("bad weight %q", match[weightGroup])
+	}
+	reading := Reading{Weight: weight, TimeStamp: now}
+	if timestampGroup > 0 && match[timestampGroup] != "" {
+		ts, err := strconv.ParseInt(match[timestampGroup], 10, 64)
+		if err != nil {
+			return Reading{}, fmt.Errorf("bad timestamp %q", match[timestampGroup])
+		}
+		reading.TimeStamp = time.Unix(ts, 0).UTC()
+	}
+	return reading, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"testing"
+)
+
+func TestScanLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"newlines", "110.5\n111\n", []string{"110.5", "111"}},
+		{"carriage returns", "110.5\r111\r", []string{"110.5", "111"}},
+		{"both", "110.5\r\n111\r\n", []string{"110.5", "111"}},
+		{"blank lines", "\r\n\r\n110.5\n\n", []string{"110.5"}},
+		{"no ending", "110.5\r111", []string{"110.5", "111"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			data := []byte(tt.input)
+			for len(data) > 0 {
+				advance, token, err := scanLines(data, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if token != nil {
+					got = append(got, string(token))
+				}
+				data = data[advance:]
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("scanLines(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSerialReaderReadLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		// The reading that ends up in the Datastore, 0 for none
+		want float64
+	}{
+		{"a line", "110\n", 110},
+		{"CR-terminated", "110\r120\r", 120},
+		{"CRLF-terminated", "110\r\n120\r\n", 120},
+		{"with units", "ST,GS,  115.5 lb\r\n", 115.5},
+		{"junk", "ERR\r\nOVERLOAD\r\n", 0},
+		{"too heavy", "120\r\n2000\r\n", 120},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, ds := newTestIngester(t)
+			s := &SerialReader{Ingest: in, SerialConfig: SerialConfig{Device: "test"}}
+			pattern, weightGroup, timestampGroup, err := s.Pattern()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, w := io.Pipe()
+			go func() {
+				io.WriteString(w, tt.output)
+				w.Close()
+			}()
+			if err := s.readLines(r, s.SerialConfig, pattern, weightGroup, timestampGroup); err != nil {
+				t.Fatalf("readLines() error = %v", err)
+			}
+
+			got := ds.Get()
+			if got.Weight != tt.want {
+				t.Errorf("the scale sent %q, got a reading of %v lbs, want %v", tt.output, got.Weight, tt.want)
+			}
+			if ok, _ := s.Health(); ok {
+				t.Errorf("the device was never opened, it shouldn't be healthy")
+			}
+			if s.lastLine.IsZero() {
+				t.Errorf("lastLine wasn't set")
+			}
+			if got := !s.lastRead.IsZero(); got != (tt.want != 0) {
+				t.Errorf("lastRead = %v, want it set only if there was a reading", s.lastRead)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"time"
+)
+
+// Simulate mode feeds made-up (or recorded) readings in instead of
+// listening to the scale, with the clock running faster than real time,
+// so alerts, forecasts and the kiosk page can be tried out without
+// waiting weeks for a real cylinder to drain.
+//
+// A recording is one reading per line in any format Ingester takes, e.g.
+// what `mosquitto_sub -t propane/weight` prints. With `mosquitto_sub -v`
+// the topic comes first, which is fine too. Lines that aren't readings
+// are skipped.
+
+// simulateConfig turns off everything that listens to the real scale
+func simulateConfig(cfg *AppConfig) {
+	cfg.MQTT.Enabled = false
+	cfg.Serial.Enabled = false
+}
+
+// How often the synthetic scale reports, in simulated time
+const syntheticEvery = time.Minute
+
+type Simulator struct {
+	Ingest *Ingester
+	// What a full cylinder looks like, for synthetic readings
+	Cylinder CylinderSettings
+	Clock    *SimClock
+	// Readings from the recording, empty for synthetic ones
+	recording []Reading
+	rand      *rand.Rand
+}
+
+// NewSimulator sets up a replay of the recording at file, or synthetic
+// readings if file is "synthetic". Either way time runs speed times
+// faster than real time.
+func NewSimulator(ingest *Ingester, cyl CylinderSettings, file string, speed float64, seed uint64) (*Simulator, error) {
+	if speed <= 0 {
+		return nil, fmt.Errorf("a speed of %g doesn't make sense", speed)
+	}
+	s := &Simulator{Ingest: ingest, Cylinder: cyl, rand: rand.New(rand.NewPCG(seed, seed))}
+	start := time.Now()
+	if file != "synthetic" {
+		recording, err := loadRecording(file)
+		if err != nil {
+			return nil, err
+		}
+		s.recording = recording
+		// Start the clock when the recording does
+		start = recording[0].TimeStamp
+	}
+	s.Clock = NewSimClock(start, speed)
+	return s, nil
+}
+
+func (s *Simulator) Run(ctx context.Context) func() error {
+	return func() error {
+		if s.recording != nil {
+			return s.replay(ctx)
+		}
+		return s.synthesize(ctx)
+	}
+}
+
+// replay feeds in each recorded reading when the clock gets to it
+func (s *Simulator) replay(ctx context.Context) error {
+	log.Printf("Replaying %d readings from %s to %s\n", len(s.recording),
+		FormatTime(s.recording[0].TimeStamp), FormatTime(s.recording[len(s.recording)-1].TimeStamp))
+	for _, r := range s.recording {
+		if err := s.sleepUntil(ctx, r.TimeStamp); err != nil {
+			return nil
+		}
+		if err := s.Ingest.Store(r); err != nil {
+			log.Printf("Ignoring recorded reading from %s: %v\n", FormatTime(r.TimeStamp), err)
+		}
+	}
+	log.Println("That's the end of the recording")
+	<-ctx.Done()
+	return nil
+}
+
+// synthesize makes up readings from a cylinder that gets used in bursts
+// (somebody firing up the forge for a few hours), with a bit of noise, the
+// odd dropout where the scale goes quiet, and a fresh cylinder a day or
+// two after it runs low (with nothing on the scale while it's swapped)
+func (s *Simulator) synthesize(ctx context.Context) error {
+	c := s.Cylinder.Get()
+	if c.FullWeight <= c.TareWeight {
+		// No (sensible) cylinder.json, so make it a 20 lb BBQ tank
+		c = Cylinder{TareWeight: 17, FullWeight: 37}
+	}
+	empty := c.TareWeight - c.ExtraWeight
+	weight := c.FullWeight
+
+	var burnRate float64 // lbs/hour
+	var burnUntil, quietUntil, refillAt, swappedAt time.Time
+	log.Printf("Simulating a %.0f lb cylinder\n", c.FullWeight-c.TareWeight)
+
+	now := s.Clock.Now()
+	for {
+		now = now.Add(syntheticEvery)
+		if err := s.sleepUntil(ctx, now); err != nil {
+			return nil
+		}
+
+		// Burning gas, or maybe starting to. About two sessions a day.
+		swapping := !swappedAt.IsZero()
+		if now.Before(burnUntil) {
+			weight = max(weight-burnRate*syntheticEvery.Hours(), empty)
+		} else if !swapping && s.rand.Float64() < 2*syntheticEvery.Hours()/24 {
+			burnRate = 1 + 2*s.rand.Float64()
+			length := time.Hour + time.Duration(s.rand.Int64N(int64(3*time.Hour)))
+			burnUntil = now.Add(length)
+			log.Printf("Simulation: burning %.1f lbs/hour for %s\n", burnRate, length.Round(time.Minute))
+		}
+
+		// Somebody swaps in a new cylinder a day or two after it gets low,
+		// and there's nothing on the scale for a few minutes while they do
+		remaining := c.CalcRemaining(weight)
+		if remaining < 10 && refillAt.IsZero() && !swapping {
+			refillAt = now.Add(24*time.Hour + time.Duration(s.rand.Int64N(int64(24*time.Hour))))
+		}
+		if !refillAt.IsZero() && now.After(refillAt) {
+			length := 5*time.Minute + time.Duration(s.rand.Int64N(int64(20*time.Minute)))
+			weight, refillAt, burnUntil, swappedAt = 0, time.Time{}, time.Time{}, now.Add(length)
+			log.Printf("Simulation: the old cylinder comes off the scale for %s\n", length.Round(time.Minute))
+		}
+		if swapping && now.After(swappedAt) {
+			weight, swappedAt = c.FullWeight, time.Time{}
+			log.Println("Simulation: fresh cylinder on the scale")
+		}
+
+		// The scale goes quiet every few days
+		if now.Before(quietUntil) {
+			continue
+		}
+		if s.rand.Float64() < syntheticEvery.Hours()/(3*24) {
+			length := 30*time.Minute + time.Duration(s.rand.Int64N(int64(3*time.Hour)))
+			quietUntil = now.Add(length)
+			log.Printf("Simulation: the scale goes quiet for %s\n", length.Round(time.Minute))
+			continue
+		}
+
+		// An empty scale can't read less than nothing
+		reading := Reading{Weight: max(weight+s.rand.NormFloat64()*0.15, 0), TimeStamp: now}
+		if err := s.Ingest.Store(reading); err != nil {
+			log.Printf("Ignoring simulated reading: %v\n", err)
+		}
+	}
+}
+
+// sleepUntil waits until the clock says it's t
+func (s *Simulator) sleepUntil(ctx context.Context, t time.Time) error {
+	wait := s.Clock.Real(t.Sub(s.Clock.Now()))
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+func loadRecording(file string) ([]Reading, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var readings []Reading
+	skipped := 0
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := ParseReading([]byte(line), time.Time{})
+		if topic, payload, ok := strings.Cut(line, " "); err != nil && ok && !strings.HasPrefix(topic, "{") {
+			// mosquitto_sub -v puts the topic first
+			r, err = ParseReading([]byte(payload), time.Time{})
+		}
+		if err != nil || r.TimeStamp.IsZero() {
+			skipped++
+			continue
+		}
+		readings = append(readings, r)
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+	if len(readings) == 0 {
+		return nil, fmt.Errorf("no readings with timestamps in %s", file)
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d lines in %s that weren't readings\n", skipped, file)
+	}
+	return readings, nil
+}
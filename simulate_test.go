@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeRecording(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "readings.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRecording(t *testing.T) {
+	path := writeRecording(t,
+		"# what mosquitto_sub printed",
+		"1577640142,163.4",
+		"",
+		`{"timestamp": 1577640202, "weight": 163.2}`,
+		"propane/weight 1577640262,163.1",
+		`propane/weight {"timestamp": 1577640322, "weight": 163}`,
+		// No timestamp, so there's no telling when to replay it
+		`{"weight": 162.9}`,
+		"Connection error",
+	)
+	got, err := loadRecording(path)
+	if err != nil {
+		t.Fatalf("loadRecording() error = %v", err)
+	}
+	want := []Reading{
+		{163.4, time.Unix(1577640142, 0).UTC()},
+		{163.2, time.Unix(1577640202, 0).UTC()},
+		{163.1, time.Unix(1577640262, 0).UTC()},
+		{163, time.Unix(1577640322, 0).UTC()},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("loadRecording() = %+v, want %+v", got, want)
+	}
+	for i := range got {
+		if got[i].Weight != want[i].Weight || !got[i].TimeStamp.Equal(want[i].TimeStamp) {
+			t.Errorf("reading %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if _, err := loadRecording(writeRecording(t, "# nothing here", `{"weight": 162.9}`)); err == nil {
+		t.Errorf("loadRecording() should fail when there aren't any readings to replay")
+	}
+}
+
+func TestNewSimulator(t *testing.T) {
+	in, _ := newTestIngester(t)
+	cyl := newTestCylinderStore(t)
+	recording := writeRecording(t, "1577640142,163.4")
+
+	tests := []struct {
+		name    string
+		file    string
+		speed   float64
+		wantErr bool
+	}{
+		{"synthetic", "synthetic", 60, false},
+		{"recording", recording, 60, false},
+		{"no speed", "synthetic", 0, true},
+		{"backwards", "synthetic", -60, true},
+		{"missing recording", filepath.Join(t.TempDir(), "nope.txt"), 60, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewSimulator(in, cyl, tt.file, tt.speed, 1)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSimulator() error = %v, want an error: %v", err, tt.wantErr)
+			}
+			// A replay starts when the recording does
+			if tt.file == recording && !s.Clock.Now().Before(time.Unix(1577640142, 0).Add(time.Hour)) {
+				t.Errorf("the clock starts at %s, want it to start with the recording", s.Clock.Now())
+			}
+		})
+	}
+}
+
+func TestSimulatorReplay(t *testing.T) {
+	in, ds := newTestIngester(t)
+	recording := writeRecording(t,
+		"1577640142,163.4",
+		"1577640742,2000",
+		"1577641342,150.5",
+	)
+	// 20 minutes of recording in a millisecond or so
+	s, err := NewSimulator(in, newTestCylinderStore(t), recording, 1e6, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Run(ctx)() }()
+
+	deadline := time.After(time.Second)
+	for ds.Get().Weight != 150.5 {
+		select {
+		case <-deadline:
+			t.Fatalf("the last reading wasn't replayed, the scale says %v lbs", ds.Get().Weight)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if got := ds.Get().TimeStamp; !got.Equal(time.Unix(1577641342, 0)) {
+		t.Errorf("the reading is from %s, want the recorded time", got)
+	}
+
+	// It waits around at the end until we're done
+	select {
+	case err := <-done:
+		t.Fatalf("the replay stopped by itself: %v", err)
+	default:
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Run() error = %v", err)
+	}
+}
+
+// Simulating doesn't listen to the real scale, even if the config says to
+// and however incomplete its settings are
+func TestSimulateConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeTestConfig(t, path, `{"mqtt": {"enabled": true}, "serial": {"enabled": true}, "discord": {"enabled": false}}`)
+
+	if _, err := BuildConfig(path, true, nil); err == nil {
+		t.Fatalf("BuildConfig() should fail without mqtt.server and serial.device")
+	}
+	cfg, err := BuildConfig(path, true, simulateConfig)
+	if err != nil {
+		t.Fatalf("BuildConfig() error = %v", err)
+	}
+	if cfg.MQTT.Enabled || cfg.Serial.Enabled {
+		t.Errorf("mqtt.enabled = %v and serial.enabled = %v, want both off", cfg.MQTT.Enabled, cfg.Serial.Enabled)
+	}
+
+	// Even when the environment turns it on
+	t.Setenv("PROPANEBOT_SERIAL_ENABLED", "true")
+	cfg, err = BuildConfig(path, true, simulateConfig)
+	if err != nil || cfg.Serial.Enabled {
+		t.Errorf("serial.enabled = %v (error %v), want it off", cfg.Serial.Enabled, err)
+	}
+}
+
+// Synthetic readings are timestamped by the simulator's clock, which is
+// what the Ingester has to check them by too
+func TestSimulatorSynthetic(t *testing.T) {
+	in, ds := newTestIngester(t)
+	// A reading every 0.6ms or so
+	s, err := NewSimulator(in, newTestCylinderStore(t), "synthetic", 1e5, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in.Clock = s.Clock
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)()
+
+	// Long enough for a few simulated hours, which would all be in the
+	// future by the real clock
+	time.Sleep(200 * time.Millisecond)
+	got := ds.Get()
+	if got.TimeStamp.Sub(s.Clock.start) < time.Hour {
+		t.Fatalf("the last reading is from %s, want one from hours into the simulation", got.TimeStamp)
+	}
+	if got.Weight < testCylinder.TareWeight || got.Weight > testCylinder.FullWeight+1 {
+		t.Errorf("the simulated cylinder weighs %v lbs, want it between empty and full", got.Weight)
+	}
+}
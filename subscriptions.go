@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"sync"
+)
+
+// Members can opt into getting a DM from the bot whenever an alert
+// of a given level goes off. The list of who wants what is kept in
+// subscriptions.json so it survives restarts.
+
+const subscriptionsFile = "subscriptions.json"
+
+type AlertLevel string
+
+const (
+	// The cylinder dropped below the low threshold (time to order)
+	AlertLow AlertLevel = "low"
+	// The cylinder dropped below the critical threshold (order NOW)
+	AlertCritical AlertLevel = "critical"
+	// At the rate we're going, it'll be empty before a new one could
+	// show up if we don't order now
+	AlertReorder AlertLevel = "reorder"
+	// The weight is dropping faster than anything in the shop should burn
+	AlertLeak AlertLevel = "leak"
+	// We haven't heard from the scale in a while
+	AlertStale AlertLevel = "stale"
+	// We can't reach the MQTT broker, so no readings are getting through
+	AlertBroker AlertLevel = "broker"
+	// The weight on the scale doesn't make sense for the cylinder (see
+	// TankState)
+	AlertNoCylinder AlertLevel = AlertLevel(TankNoCylinder)
+	AlertOverFull   AlertLevel = AlertLevel(TankOverFull)
+	AlertBelowTare  AlertLevel = AlertLevel(TankBelowTare)
+	// It's been alerts.calibrationMonths since the scale was calibrated
+	AlertCalibration AlertLevel = "calibration"
+)
+
+// All the alert levels a member can subscribe to, in the order they
+// should be shown
+var alertLevels = []AlertLevel{AlertLow, AlertCritical, AlertReorder, AlertLeak, AlertStale, AlertBroker, AlertNoCylinder, AlertOverFull, AlertBelowTare, AlertCalibration}
+
+// Whether dealing with the alert means ordering gas
+func (l AlertLevel) NeedsOrder() bool {
+	return l == AlertLow || l == AlertCritical || l == AlertReorder
+}
+
+func ParseAlertLevel(s string) (AlertLevel, error) {
+	for _, l := range alertLevels {
+		if string(l) == s {
+			return l, nil
+		}
+	}
+	return "", errors.New("unknown alert level " + s)
+}
+
+type SubscriptionStore struct {
+	path string
+	// Discord user ID -> the alert levels they want DMs for
+	users map[string][]AlertLevel
+	lock  sync.RWMutex
+}
+
+// NewSubscriptionStore loads the subscriptions kept at path. A missing
+// file just means nobody has subscribed yet.
+func NewSubscriptionStore(path string) *SubscriptionStore {
+	s := &SubscriptionStore{
+		path:  path,
+		users: map[string][]AlertLevel{},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Failed to read subscriptions: %s\n", err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(data, &s.users); err != nil {
+		log.Printf("Failed to parse subscriptions: %s\n", err)
+	}
+	return s
+}
+
+// Subscribe adds the given levels to the user's subscriptions
+func (s *SubscriptionStore) Subscribe(userID string, levels []AlertLevel) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	current := s.users[userID]
+	for _, l := range levels {
+		if !slices.Contains(current, l) {
+			current = append(current, l)
+		}
+	}
+	s.users[userID] = current
+	return s.save()
+}
+
+// Unsubscribe removes the given levels from the user's subscriptions,
+// or all of them if no levels are given
+func (s *SubscriptionStore) Unsubscribe(userID string, levels []AlertLevel) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(levels) > 0 {
+		s.users[userID] = slices.DeleteFunc(s.users[userID], func(l AlertLevel) bool {
+			return slices.Contains(levels, l)
+		})
+	}
+	if len(levels) == 0 || len(s.users[userID]) == 0 {
+		delete(s.users, userID)
+	}
+	return s.save()
+}
+
+// Levels returns the levels the user is currently subscribed to
+func (s *SubscriptionStore) Levels(userID string) []AlertLevel {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var levels []AlertLevel
+	for _, l := range alertLevels {
+		if slices.Contains(s.users[userID], l) {
+			levels = append(levels, l)
+		}
+	}
+	return levels
+}
+
+// Subscribers returns the IDs of every user who wants to hear about
+// alerts of the given level
+func (s *SubscriptionStore) Subscribers(level AlertLevel) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	var ids []string
+	for id, levels := range s.users {
+		if slices.Contains(levels, level) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// Must be called with the lock held
+func (s *SubscriptionStore) save() error {
+	data, err := json.MarshalIndent(s.users, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0644)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Runs each part of the bot (MQTT, Discord, the web server...) on its
+// own, so one of them failing (say Discord is down, or the token is
+// wrong) doesn't take the rest down with it. Failed components are
+// restarted with backoff, and everyone's status is kept for /healthz and
+// /readyz.
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+	// A component that ran at least this long before failing gets to
+	// start over with the shortest backoff
+	backoffReset = time.Minute
+)
+
+type ComponentState string
+
+const (
+	ComponentRunning  ComponentState = "running"
+	ComponentFailed   ComponentState = "failed"
+	ComponentStopped  ComponentState = "stopped"
+	ComponentDisabled ComponentState = "disabled"
+	// Done with whatever it had to do, which isn't a problem
+	ComponentFinished ComponentState = "finished"
+)
+
+type ComponentStatus struct {
+	Name  string         `json:"name"`
+	State ComponentState `json:"state"`
+	// What went wrong last time, if anything
+	Error string    `json:"error,omitempty"`
+	Since time.Time `json:"since"`
+	// How many times it's been restarted after failing
+	Restarts int `json:"restarts"`
+	// When it'll be retried, if it failed
+	RetryAt time.Time `json:"retryAt,omitzero"`
+	// Whether it's actually doing its job, not just running (e.g. MQTT is
+	// connected and subscribed)
+	Ready bool `json:"ready"`
+	// Whatever its health check had to say
+	Details any `json:"details,omitempty"`
+}
+
+// HealthCheck says whether a component is ready, along with anything that
+// helps figure out why not
+type HealthCheck func() (ready bool, details any)
+
+type Supervisor struct {
+	group      *errgroup.Group
+	ctx        context.Context
+	components map[string]*ComponentStatus
+	checks     map[string]HealthCheck
+	lock       sync.RWMutex
+}
+
+func NewSupervisor(ctx context.Context) (*Supervisor, context.Context) {
+	group, ctx := errgroup.WithContext(ctx)
+	return &Supervisor{
+		group:      group,
+		ctx:        ctx,
+		components: map[string]*ComponentStatus{},
+		checks:     map[string]HealthCheck{},
+	}, ctx
+}
+
+// Go runs the component, restarting it with backoff whenever it returns an
+// error (or panics) until we're shutting down
+func (s *Supervisor) Go(name string, run func() error) {
+	s.set(name, ComponentRunning, nil, time.Time{})
+	s.group.Go(func() error {
+		backoff := minBackoff
+		for {
+			started := time.Now()
+			err := s.runOnce(run)
+			if s.ctx.Err() != nil {
+				s.set(name, ComponentStopped, err, time.Time{})
+				return nil
+			}
+			if err == nil {
+				// Finished on its own, nothing to restart
+				s.set(name, ComponentFinished, nil, time.Time{})
+				return nil
+			}
+
+			if time.Since(started) >= backoffReset {
+				backoff = minBackoff
+			}
+			log.Printf("%s failed: %v. Trying again in %s\n", name, err, backoff)
+			s.set(name, ComponentFailed, err, time.Now().Add(backoff))
+
+			select {
+			case <-s.ctx.Done():
+				s.set(name, ComponentStopped, err, time.Time{})
+				return nil
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, maxBackoff)
+
+			s.lock.Lock()
+			s.components[name].Restarts++
+			s.lock.Unlock()
+			s.set(name, ComponentRunning, nil, time.Time{})
+		}
+	})
+}
+
+// Disabled records that a component was turned off in the config
+func (s *Supervisor) Disabled(name string) {
+	s.set(name, ComponentDisabled, nil, time.Time{})
+}
+
+// Check sets the health check for a component. Without one, a component is
+// ready as long as it's running.
+func (s *Supervisor) Check(name string, check HealthCheck) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.checks[name] = check
+}
+
+// Wait waits for every component to stop
+func (s *Supervisor) Wait() error {
+	return s.group.Wait()
+}
+
+// Status returns how every component is doing, sorted by name
+func (s *Supervisor) Status() []ComponentStatus {
+	s.lock.RLock()
+	var status []ComponentStatus
+	for _, c := range s.components {
+		status = append(status, *c)
+	}
+	checks := maps.Clone(s.checks)
+	s.lock.RUnlock()
+
+	// The checks take the components' own locks, so don't hold ours
+	for i, c := range status {
+		if c.State == ComponentDisabled || c.State == ComponentFinished {
+			continue
+		}
+		ready := c.State == ComponentRunning
+		if check, ok := checks[c.Name]; ok {
+			checkReady, details := check()
+			ready = ready && checkReady
+			status[i].Details = details
+		}
+		status[i].Ready = ready
+	}
+	slices.SortFunc(status, func(a, b ComponentStatus) int { return strings.Compare(a.Name, b.Name) })
+	return status
+}
+
+// runOnce runs the component, turning a panic into an error
+func (s *Supervisor) runOnce(run func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return run()
+}
+
+func (s *Supervisor) set(name string, state ComponentState, err error, retryAt time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, ok := s.components[name]
+	if !ok {
+		c = &ComponentStatus{Name: name}
+		s.components[name] = c
+	}
+	if c.State != state {
+		c.Since = time.Now()
+	}
+	c.State = state
+	c.Error = ""
+	if err != nil {
+		c.Error = err.Error()
+	}
+	c.RetryAt = retryAt
+}
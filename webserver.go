@@ -2,80 +2,211 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type WebServer struct {
-	Port      int
-	Datastore *Datastore
-	server    *http.Server
+	Port int
+	// Bearer token for POST /api/readings, which is off if it's empty
+	IngestToken string
+	Ingest      *Ingester
+	Datastore   ReadingSource
+	Cylinder    CylinderSettings
+	Calibration *CalibrationStore
+	Orders      *OrderStore
+	History     *ConsumptionHistory
+	// Where /healthz gets everyone's status from
+	Health *Supervisor
+	server *http.Server
+	// Guards Port and IngestToken, which can change when config.json does
+	lock sync.Mutex
+	// Tells Run to start listening on the new port
+	restart chan struct{}
+}
+
+// SetIngestToken changes the token needed to POST readings
+func (ws *WebServer) SetIngestToken(token string) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	ws.IngestToken = token
+}
+
+// SetPort moves the web server to a different port
+func (ws *WebServer) SetPort(port int) {
+	ws.lock.Lock()
+	defer ws.lock.Unlock()
+	ws.Port = port
+	if ws.restart != nil {
+		select {
+		case ws.restart <- struct{}{}:
+		default:
+		}
+	}
 }
 
 func (ws *WebServer) Run(ctx context.Context) func() error {
 	return func() error {
-		mux := http.NewServeMux()
+		for {
+			restarted, err := ws.serve(ctx)
+			if !restarted {
+				return err
+			}
+		}
+	}
+}
 
-		// Endpoint that returns the same string as Discord bot
-		mux.HandleFunc("/propane", ws.handlePropaneText)
+// serve runs the web server until we're shutting down or the port changes,
+// in which case it returns true
+func (ws *WebServer) serve(ctx context.Context) (bool, error) {
+	ws.lock.Lock()
+	if ws.restart == nil {
+		ws.restart = make(chan struct{}, 1)
+	}
+	restart := ws.restart
+	port := ws.Port
+	ws.lock.Unlock()
 
-		// JSON API endpoint for structured data
-		mux.HandleFunc("/api/propane", ws.handlePropaneJSON)
+	mux := http.NewServeMux()
 
-		// Cylinder settings page: view/edit cylinder.json values
-		mux.HandleFunc("/cylinder", ws.handleCylinderSettings)
+	// Endpoint that returns the same string as Discord bot
+	mux.HandleFunc("/propane", ws.handlePropaneText)
 
-		// Serve static files for the web page
-		mux.HandleFunc("/", ws.handleIndex)
+	// JSON API endpoint for structured data
+	mux.HandleFunc("/api/propane", ws.handlePropaneJSON)
 
-		ws.server = &http.Server{
-			Addr:    fmt.Sprintf(":%d", ws.Port),
-			Handler: mux,
-		}
+	// The same thing as a stream of server-sent events, sent whenever
+	// there's a new reading (or the cylinder settings change), so the
+	// kiosk page doesn't have to keep asking
+	mux.HandleFunc("GET /api/propane/events", ws.handlePropaneEvents)
 
-		// Start server in a goroutine
-		go func() {
-			log.Printf("Web server starting on port %d", ws.Port)
-			if err := ws.server.ListenAndServe(); err != http.ErrServerClosed {
-				log.Printf("Web server error: %v", err)
-			}
-		}()
+	// For scales that can only do HTTP, see ingest.go for the payload
+	mux.HandleFunc("POST /api/readings", ws.handleReadings)
 
-		// Wait for context to be done, then shutdown
-		<-ctx.Done()
-		log.Printf("Web server received shutdown signal. Shutting down...")
+	// Cylinder settings page: view/edit cylinder.json values
+	mux.HandleFunc("/cylinder", ws.handleCylinderSettings)
 
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
+	// Walks through calibrating the scale with known reference weights,
+	// and the same thing as an API
+	mux.HandleFunc("/calibration", ws.handleCalibration)
+	mux.HandleFunc("GET /api/calibration", ws.handleCalibrationJSON)
+	mux.HandleFunc("POST /api/calibration", ws.handleCalibrationFinish)
+	mux.HandleFunc("POST /api/calibration/points", ws.handleCalibrationPoint)
+	mux.HandleFunc("DELETE /api/calibration/points", ws.handleCalibrationClear)
 
-		return ws.server.Shutdown(shutdownCtx)
+	// Gas order tracking page and a CSV export of the order history
+	mux.HandleFunc("/orders", ws.handleOrders)
+	mux.HandleFunc("/orders.csv", ws.handleOrdersCSV)
+
+	// How each part of the bot is doing, for monitoring. /healthz is
+	// whether everything is running, /readyz whether it's all actually
+	// working (MQTT connected, Discord logged in, cylinder.json makes
+	// sense...)
+	mux.HandleFunc("/healthz", ws.handleHealth)
+	mux.HandleFunc("/readyz", ws.handleReady)
+
+	// Serve static files for the web page
+	mux.HandleFunc("/", ws.handleIndex)
+
+	// Cancelled before shutting down, so the event streams (which would
+	// otherwise go on forever) finish up and let Shutdown get on with it
+	serveCtx, stopServing := context.WithCancel(ctx)
+	defer stopServing()
+
+	ws.server = &http.Server{
+		Addr:        fmt.Sprintf(":%d", port),
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return serveCtx },
 	}
+
+	// Start server in a goroutine
+	failed := make(chan error, 1)
+	go func(server *http.Server) {
+		log.Printf("Web server starting on port %d", port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			failed <- err
+		}
+	}(ws.server)
+
+	// Wait for context to be done (or the port to change), then shutdown
+	restarted := false
+	select {
+	case err := <-failed:
+		return false, fmt.Errorf("web server: %w", err)
+	case <-ctx.Done():
+		log.Printf("Web server received shutdown signal. Shutting down...")
+	case <-restart:
+		log.Printf("Web server port changed. Restarting...")
+		restarted = true
+	}
+
+	stopServing()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return restarted, ws.server.Shutdown(shutdownCtx)
 }
 
 func (ws *WebServer) handlePropaneText(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	fmt.Fprint(w, ws.Datastore.GetString())
+	fmt.Fprint(w, ws.message())
 }
 
-func (ws *WebServer) handlePropaneJSON(w http.ResponseWriter, r *http.Request) {
-	data := ws.Datastore.Get()
+// The same thing the Discord bot says for /weight
+func (ws *WebServer) message() string {
+	return describeTank(ws.Datastore, ws.History)
+}
 
-	response := struct {
-		Weight    float64   `json:"weight"`
-		TimeStamp time.Time `json:"timestamp"`
-		Remaining float64   `json:"remaining"`
-		Message   string    `json:"message"`
-	}{
+// What /api/propane (and its event stream) says about the tank
+type propaneResponse struct {
+	Weight    float64   `json:"weight"`
+	TimeStamp time.Time `json:"timestamp"`
+	// The timestamp as people should see it, and how long ago it was
+	Time string `json:"time"`
+	Ago  string `json:"ago"`
+	// null with no cylinder on the scale, and State says whether the
+	// weight makes sense for the cylinder at all
+	Remaining *float64  `json:"remaining"`
+	State     TankState `json:"state"`
+	Message   string    `json:"message"`
+	// Only there once we know enough to make a forecast
+	LbsPerDay     *float64 `json:"lbsPerDay"`
+	DaysRemaining *float64 `json:"daysRemaining"`
+}
+
+func (ws *WebServer) propaneResponse(data CurrentData) propaneResponse {
+	response := propaneResponse{
 		Weight:    data.Weight,
 		TimeStamp: data.TimeStamp,
-		Remaining: data.Remaining,
-		Message:   ws.Datastore.GetString(),
+		Time:      FormatTime(data.TimeStamp),
+		Ago:       TimeAgo(data.TimeStamp, Now()),
+		Remaining: data.remaining(),
+		State:     data.State,
+		Message:   ws.message(),
+	}
+	if f, ok := ws.History.Forecast(); ok {
+		response.LbsPerDay = &f.LbsPerDay
+		response.DaysRemaining = &f.DaysRemaining
 	}
+	return response
+}
+
+func (ws *WebServer) handlePropaneJSON(w http.ResponseWriter, r *http.Request) {
+	response := ws.propaneResponse(ws.Datastore.Get())
 
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -86,6 +217,51 @@ func (ws *WebServer) handlePropaneJSON(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// How often the event stream repeats itself when nothing's changed, which
+// keeps "3 minutes ago" up to date and the connection from being dropped
+// by anything in between for being idle
+const eventsKeepalive = 30 * time.Second
+
+// handlePropaneEvents sends what /api/propane would as a server-sent event
+// straight away, and then again every time it changes
+func (ws *WebServer) handlePropaneEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming isn't supported", http.StatusInternalServerError)
+		return
+	}
+	updates, stop := ws.Datastore.Watch()
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ticker := time.NewTicker(eventsKeepalive)
+	defer ticker.Stop()
+	data := ws.Datastore.Get()
+	for {
+		payload, err := json.Marshal(ws.propaneResponse(data))
+		if err != nil {
+			log.Printf("Failed to encode propane event: %v\n", err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", payload); err != nil {
+			// They've gone away
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-r.Context().Done():
+			return
+		case data = <-updates:
+		case <-ticker.C:
+			data = ws.Datastore.Get()
+		}
+	}
+}
+
 func (ws *WebServer) handleCylinderSettings(w http.ResponseWriter, r *http.Request) {
 	var errMsg string
 	var savedOK bool
@@ -102,7 +278,7 @@ func (ws *WebServer) handleCylinderSettings(w http.ResponseWriter, r *http.Reque
 				errMsg = "All fields must be valid numbers (with decimal points!)"
 			} else {
 				c := Cylinder{TareWeight: tare, FullWeight: full, ExtraWeight: extra}
-				if err := SaveCylinderData(c); err != nil {
+				if err := ws.Cylinder.Save(c); err != nil {
 					errMsg = fmt.Sprintf("Hmm, failed to save cylinder.json: %v", err)
 				} else {
 					savedOK = true
@@ -111,7 +287,7 @@ func (ws *WebServer) handleCylinderSettings(w http.ResponseWriter, r *http.Reque
 		}
 	}
 
-	data := GetCylinderData()
+	data := ws.Cylinder.Get()
 
 	var statusHTML string
 	if errMsg != "" {
@@ -242,6 +418,698 @@ func (ws *WebServer) handleCylinderSettings(w http.ResponseWriter, r *http.Reque
 	fmt.Fprint(w, html)
 }
 
+func (ws *WebServer) handleOrders(w http.ResponseWriter, r *http.Request) {
+	var errMsg, okMsg string
+
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			errMsg = "Failed to parse form data"
+		} else if state, err := ParseOrderState(r.FormValue("state")); err != nil {
+			errMsg = err.Error()
+		} else {
+			details := OrderDetails{
+				OrderedByName: strings.TrimSpace(r.FormValue("name")),
+				Supplier:      strings.TrimSpace(r.FormValue("supplier")),
+			}
+			if state != OrderOrdered {
+				// Only whoever placed the order gets recorded
+				details.OrderedByName = ""
+			}
+			if v := r.FormValue("expected"); v != "" {
+				if details.ExpectedDelivery, err = ParseDate(v); err != nil {
+					errMsg = "The expected delivery date doesn't look like a date"
+				}
+			}
+			if v := r.FormValue("cost"); v != "" {
+				if details.Cost, err = strconv.ParseFloat(v, 64); err != nil {
+					errMsg = "The cost must be a number"
+				}
+			}
+			if errMsg == "" {
+				if order, err := ws.Orders.Advance(state, Now(), details); err != nil {
+					errMsg = "Can't do that: " + err.Error()
+				} else {
+					okMsg = order.Describe()
+				}
+			}
+		}
+	}
+
+	var statusHTML string
+	if errMsg != "" {
+		statusHTML = fmt.Sprintf(`<div class="status error"><div>%s</div></div>`, html.EscapeString(errMsg))
+	} else if okMsg != "" {
+		statusHTML = fmt.Sprintf(`<div class="status"><div>Got it! %s.</div></div>`, html.EscapeString(okMsg))
+	} else if o, ok := ws.Orders.Current(); ok {
+		statusHTML = fmt.Sprintf(`<div class="status"><div>%s.</div></div>`, html.EscapeString(o.Describe()))
+	} else {
+		statusHTML = `<div class="status"><div>There's no order in progress.</div></div>`
+	}
+
+	day := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return LocalTime(t).Format("Jan _2 2006")
+	}
+	// Expected delivery is just a date, there's no timezone to convert
+	date := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("Jan _2 2006")
+	}
+	var rows strings.Builder
+	for _, o := range ws.Orders.All() {
+		cost := ""
+		if o.Cost != 0 {
+			cost = fmt.Sprintf("$%.2f", o.Cost)
+		}
+		fmt.Fprintf(&rows, "<tr><td>%d</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td><td>%s</td></tr>\n",
+			o.ID, o.State, day(o.NeededAt), html.EscapeString(o.OrderedByName), html.EscapeString(o.Supplier),
+			day(o.OrderedAt), date(o.ExpectedDelivery), day(o.DeliveredAt), day(o.InstalledAt), cost)
+	}
+
+	page := fmt.Sprintf(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Propane Orders</title>
+    <style>
+        * {
+            box-sizing: border-box;
+        }
+        body {
+            font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif;
+            margin: 0;
+            padding: 1rem;
+            background: linear-gradient(135deg, #667eea 0%%, #764ba2 100%%);
+            min-height: 100vh;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+        }
+        .container {
+            background-color: white;
+            border-radius: 15px;
+            box-shadow: 0 10px 30px rgba(0,0,0,0.2);
+            width: 95vw;
+            max-width: 1000px;
+            overflow: hidden;
+        }
+        .header {
+            background: linear-gradient(135deg, #667eea 0%%, #764ba2 100%%);
+            color: white;
+            padding: 2rem;
+            text-align: center;
+        }
+        .header h1 {
+            margin: 0 0 0.5rem 0;
+            font-size: clamp(1.3rem, 4vw, 2rem);
+        }
+        .header p {
+            margin: 0;
+            opacity: 0.9;
+            font-size: clamp(0.85rem, 2vw, 1rem);
+        }
+        .content {
+            padding: 2rem;
+        }
+        .status {
+            background-color: #e8f4fd;
+            padding: 1rem 1.5rem;
+            border-radius: 10px;
+            border-left: 4px solid #2196F3;
+            margin-bottom: 1.5rem;
+            font-size: clamp(0.9rem, 2vw, 1rem);
+        }
+        .status.error {
+            background-color: #ffebee;
+            border-left-color: #f44336;
+        }
+        .fields {
+            display: grid;
+            grid-template-columns: repeat(auto-fit, minmax(200px, 1fr));
+            gap: 0 1rem;
+        }
+        label {
+            display: block;
+            font-weight: bold;
+            color: #333;
+            margin-bottom: 0.4rem;
+            font-size: 0.95rem;
+        }
+        input {
+            width: 100%%;
+            padding: 0.75rem;
+            margin-bottom: 1.25rem;
+            border: 2px solid #e0e0e0;
+            border-radius: 8px;
+            font-size: 1rem;
+        }
+        input:focus {
+            outline: none;
+            border-color: #667eea;
+        }
+        .buttons {
+            display: grid;
+            grid-template-columns: repeat(auto-fit, minmax(120px, 1fr));
+            gap: 0.5rem;
+        }
+        button {
+            padding: 0.9rem;
+            border: none;
+            border-radius: 8px;
+            background: linear-gradient(45deg, #4CAF50, #8BC34A);
+            color: white;
+            font-size: 1rem;
+            font-weight: bold;
+            cursor: pointer;
+        }
+        button.cancel {
+            background: linear-gradient(45deg, #f44336, #FF5722);
+        }
+        button:hover {
+            opacity: 0.9;
+        }
+        table {
+            width: 100%%;
+            border-collapse: collapse;
+            margin-top: 2rem;
+            font-size: 0.9rem;
+        }
+        th, td {
+            padding: 0.5rem;
+            border-bottom: 1px solid #e0e0e0;
+            text-align: left;
+        }
+        .history {
+            overflow-x: auto;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <div class="header">
+            <h1>Propane Orders</h1>
+            <p>Who ordered what, from where, and when it showed up.</p>
+        </div>
+        <div class="content">
+            %s
+            <form method="POST" action="/orders">
+                <div class="fields">
+                    <div>
+                        <label for="name">Your name</label>
+                        <input type="text" id="name" name="name">
+                    </div>
+                    <div>
+                        <label for="supplier">Supplier</label>
+                        <input type="text" id="supplier" name="supplier">
+                    </div>
+                    <div>
+                        <label for="expected">Expected delivery</label>
+                        <input type="date" id="expected" name="expected">
+                    </div>
+                    <div>
+                        <label for="cost">Cost ($)</label>
+                        <input type="number" step="any" id="cost" name="cost">
+                    </div>
+                </div>
+                <div class="buttons">
+                    <button type="submit" name="state" value="needed">We need one</button>
+                    <button type="submit" name="state" value="ordered">I ordered it</button>
+                    <button type="submit" name="state" value="delivered">It showed up</button>
+                    <button type="submit" name="state" value="installed">It's hooked up</button>
+                    <button type="submit" name="state" value="cancelled" class="cancel">Cancel</button>
+                </div>
+            </form>
+            <div class="history">
+                <table>
+                    <tr><th>#</th><th>State</th><th>Needed</th><th>Ordered by</th><th>Supplier</th><th>Ordered</th><th>Expected</th><th>Delivered</th><th>Installed</th><th>Cost</th></tr>
+                    %s
+                </table>
+            </div>
+            <p><a href="/orders.csv">Download as CSV</a></p>
+        </div>
+    </div>
+</body>
+</html>`, statusHTML, rows.String())
+
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprint(w, page)
+}
+
+// addCalibrationPoint compares the reference weight with the latest
+// reading from the scale
+func (ws *WebServer) addCalibrationPoint(reference float64) (CalibrationPoint, error) {
+	raw, ok := ws.Ingest.LatestRaw()
+	if !ok {
+		return CalibrationPoint{}, errors.New("there haven't been any readings from the scale yet")
+	}
+	if math.IsNaN(reference) || math.IsInf(reference, 0) || reference < 0 || reference > maxWeight {
+		return CalibrationPoint{}, fmt.Errorf("a reference weight of %v lbs doesn't make sense", reference)
+	}
+	p := CalibrationPoint{Reference: reference, Raw: raw.Weight, At: raw.TimeStamp}
+	return p, ws.Calibration.AddPoint(p)
+}
+
+func (ws *WebServer) handleCalibration(w http.ResponseWriter, r *http.Request) {
+	var errMsg, okMsg string
+
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			errMsg = "Failed to parse form data"
+		} else {
+			switch r.FormValue("action") {
+			case "add":
+				reference, err := strconv.ParseFloat(r.FormValue("reference"), 64)
+				if err != nil {
+					errMsg = "The reference weight must be a number"
+				} else if p, err := ws.addCalibrationPoint(reference); err != nil {
+					errMsg = "Can't do that: " + err.Error()
+				} else {
+					okMsg = fmt.Sprintf("Got it, the scale said %.2f lbs for %g lbs.", p.Raw, p.Reference)
+				}
+			case "clear":
+				ws.Calibration.ClearPending()
+				okMsg = "Starting over."
+			case "save":
+				if c, err := ws.Calibration.Finish(Now(), strings.TrimSpace(r.FormValue("name"))); err != nil {
+					errMsg = "Can't do that: " + err.Error()
+				} else {
+					okMsg = "Whee! " + c.Describe() + "."
+				}
+			default:
+				errMsg = "Hmm, not sure what you wanted to do there"
+			}
+		}
+	}
+
+	now := Now()
+	var statusHTML string
+	if errMsg != "" {
+		statusHTML = fmt.Sprintf(`<div class="status error"><div>%s</div></div>`, html.EscapeString(errMsg))
+	} else if okMsg != "" {
+		statusHTML = fmt.Sprintf(`<div class="status"><div>%s</div></div>`, html.EscapeString(okMsg))
+	} else if c, ok := ws.Calibration.Current(); !ok {
+		statusHTML = `<div class="status"><div>The scale has never been calibrated, so readings are used as they are.</div></div>`
+	} else if dueAt, due := ws.Calibration.Due(now); due {
+		statusHTML = fmt.Sprintf(`<div class="status error"><div>%s. That was %s, so it's due for another one.</div></div>`,
+			html.EscapeString(c.Describe()), TimeAgo(c.At, now))
+	} else {
+		statusHTML = fmt.Sprintf(`<div class="status"><div>%s.</div></div>`, html.EscapeString(c.Describe()))
+		if !dueAt.IsZero() {
+			statusHTML = fmt.Sprintf(`<div class="status"><div>%s. The next one is due %s.</div></div>`,
+				html.EscapeString(c.Describe()), LocalTime(dueAt).Format("Jan _2 2006"))
+		}
+	}
+
+	latest := "There haven't been any readings from the scale yet."
+	if raw, ok := ws.Ingest.LatestRaw(); ok {
+		latest = fmt.Sprintf("The scale says <strong>%.2f lbs</strong> (before any corrections), as of %s.", raw.Weight, FormatTimeAgo(raw.TimeStamp, now))
+	}
+
+	var points strings.Builder
+	for _, p := range ws.Calibration.Pending() {
+		fmt.Fprintf(&points, "<tr><td>%g</td><td>%.2f</td><td>%s</td></tr>\n", p.Reference, p.Raw, FormatTime(p.At))
+	}
+	if points.Len() == 0 {
+		points.WriteString(`<tr><td colspan="3">None yet</td></tr>`)
+	}
+
+	var history strings.Builder
+	for _, c := range ws.Calibration.History() {
+		fmt.Fprintf(&history, "<tr><td>%s</td><td>%s</td><td>%d</td><td>%.4f</td><td>%+.2f</td></tr>\n",
+			FormatTime(c.At), html.EscapeString(c.By), len(c.Points), c.Gain, c.Offset)
+	}
+
+	page := fmt.Sprintf(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Scale Calibration</title>
+    <style>
+        * {
+            box-sizing: border-box;
+        }
+        body {
+            font-family: 'Segoe UI', Tahoma, Geneva, Verdana, sans-serif;
+            margin: 0;
+            padding: 1rem;
+            background: linear-gradient(135deg, #667eea 0%%, #764ba2 100%%);
+            min-height: 100vh;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+        }
+        .container {
+            background-color: white;
+            border-radius: 15px;
+            box-shadow: 0 10px 30px rgba(0,0,0,0.2);
+            width: 95vw;
+            max-width: 700px;
+            overflow: hidden;
+        }
+        .header {
+            background: linear-gradient(135deg, #667eea 0%%, #764ba2 100%%);
+            color: white;
+            padding: 2rem;
+            text-align: center;
+        }
+        .header h1 {
+            margin: 0 0 0.5rem 0;
+            font-size: clamp(1.3rem, 4vw, 2rem);
+        }
+        .header p {
+            margin: 0;
+            opacity: 0.9;
+            font-size: clamp(0.85rem, 2vw, 1rem);
+        }
+        .content {
+            padding: 2rem;
+        }
+        .status {
+            background-color: #e8f4fd;
+            padding: 1rem 1.5rem;
+            border-radius: 10px;
+            border-left: 4px solid #2196F3;
+            margin-bottom: 1.5rem;
+            font-size: clamp(0.9rem, 2vw, 1rem);
+        }
+        .status.error {
+            background-color: #ffebee;
+            border-left-color: #f44336;
+        }
+        label {
+            display: block;
+            font-weight: bold;
+            color: #333;
+            margin-bottom: 0.4rem;
+            font-size: 0.95rem;
+        }
+        input {
+            width: 100%%;
+            padding: 0.75rem;
+            margin-bottom: 1.25rem;
+            border: 2px solid #e0e0e0;
+            border-radius: 8px;
+            font-size: 1rem;
+        }
+        input:focus {
+            outline: none;
+            border-color: #667eea;
+        }
+        .buttons {
+            display: grid;
+            grid-template-columns: repeat(auto-fit, minmax(120px, 1fr));
+            gap: 0.5rem;
+            margin-bottom: 1.5rem;
+        }
+        button {
+            padding: 0.9rem;
+            border: none;
+            border-radius: 8px;
+            background: linear-gradient(45deg, #4CAF50, #8BC34A);
+            color: white;
+            font-size: 1rem;
+            font-weight: bold;
+            cursor: pointer;
+        }
+        button.cancel {
+            background: linear-gradient(45deg, #f44336, #FF5722);
+        }
+        button:hover {
+            opacity: 0.9;
+        }
+        table {
+            width: 100%%;
+            border-collapse: collapse;
+            margin-bottom: 1.5rem;
+            font-size: 0.9rem;
+        }
+        th, td {
+            padding: 0.5rem;
+            border-bottom: 1px solid #e0e0e0;
+            text-align: left;
+        }
+        ol {
+            padding-left: 1.25rem;
+        }
+        li {
+            margin-bottom: 0.5rem;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <div class="header">
+            <h1>Scale Calibration</h1>
+            <p>Scales drift. Putting things we know the weight of on it tells us by how much.</p>
+        </div>
+        <div class="content">
+            %s
+            <ol>
+                <li>Put something you know the weight of on the scale. An empty scale counts, that's 0 lbs.</li>
+                <li>Wait for a new reading (<a href="/calibration">check again</a>), type in what it really weighs and add it.</li>
+                <li>Do that again with something else. Two or more weights at least %g lbs apart (like an empty scale and a 45 lb plate) correct how far off the scale gets as things get heavier, not just how far off it is.</li>
+                <li>Save it, and put the cylinder back!</li>
+            </ol>
+            <div class="status"><div>%s</div></div>
+            <form method="POST" action="/calibration">
+                <label for="reference">What's on the scale really weighs (lbs)</label>
+                <input type="number" step="any" min="0" id="reference" name="reference">
+                <label for="name">Your name</label>
+                <input type="text" id="name" name="name">
+                <div class="buttons">
+                    <button type="submit" name="action" value="add">Add it</button>
+                    <button type="submit" name="action" value="save">Save the calibration</button>
+                    <button type="submit" name="action" value="clear" class="cancel">Start over</button>
+                </div>
+            </form>
+            <h3>Reference weights so far</h3>
+            <table>
+                <tr><th>Reference (lbs)</th><th>Scale said (lbs)</th><th>Read at</th></tr>
+                %s
+            </table>
+            <h3>Past calibrations</h3>
+            <table>
+                <tr><th>When</th><th>By</th><th>Weights</th><th>Gain</th><th>Offset (lbs)</th></tr>
+                %s
+            </table>
+        </div>
+    </div>
+</body>
+</html>`, statusHTML, minGainSpread, latest, points.String(), history.String())
+
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprint(w, page)
+}
+
+// What /api/calibration says about how the calibration's going
+type calibrationResponse struct {
+	// The latest calibration, null if there's never been one
+	Current *Calibration `json:"current"`
+	// When the next one's due, null if it never is (including when there's
+	// never been one)
+	DueAt *time.Time `json:"dueAt"`
+	Due   bool       `json:"due"`
+	// The latest reading before it's corrected, which is what reference
+	// weights get compared with
+	Raw *struct {
+		Weight    float64   `json:"weight"`
+		TimeStamp time.Time `json:"timestamp"`
+	} `json:"raw"`
+	// The reference weights so far for the calibration in progress
+	Pending []CalibrationPoint `json:"pending"`
+	// Every calibration, most recent first
+	History []Calibration `json:"history"`
+}
+
+func (ws *WebServer) writeCalibration(w http.ResponseWriter) {
+	response := calibrationResponse{
+		Pending: ws.Calibration.Pending(),
+		History: ws.Calibration.History(),
+	}
+	if c, ok := ws.Calibration.Current(); ok {
+		response.Current = &c
+	}
+	dueAt, due := ws.Calibration.Due(Now())
+	response.Due = due
+	if !dueAt.IsZero() {
+		response.DueAt = &dueAt
+	}
+	if raw, ok := ws.Ingest.LatestRaw(); ok {
+		response.Raw = &struct {
+			Weight    float64   `json:"weight"`
+			TimeStamp time.Time `json:"timestamp"`
+		}{raw.Weight, raw.TimeStamp}
+	}
+	if response.Pending == nil {
+		response.Pending = []CalibrationPoint{}
+	}
+	if response.History == nil {
+		response.History = []Calibration{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
+	}
+}
+
+func (ws *WebServer) handleCalibrationJSON(w http.ResponseWriter, r *http.Request) {
+	ws.writeCalibration(w)
+}
+
+// handleCalibrationPoint adds a reference weight, {"reference": 45}, to
+// the calibration in progress
+func (ws *WebServer) handleCalibrationPoint(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Reference *float64 `json:"reference"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if body.Reference == nil {
+		http.Error(w, "reference is missing", http.StatusBadRequest)
+		return
+	}
+	if _, err := ws.addCalibrationPoint(*body.Reference); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ws.writeCalibration(w)
+}
+
+// handleCalibrationClear starts the calibration in progress over
+func (ws *WebServer) handleCalibrationClear(w http.ResponseWriter, r *http.Request) {
+	ws.Calibration.ClearPending()
+	ws.writeCalibration(w)
+}
+
+// handleCalibrationFinish works out and saves the calibration from the
+// reference weights so far. The body can say who did it, {"by": "Sam"}.
+func (ws *WebServer) handleCalibrationFinish(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		By string `json:"by"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := ws.Calibration.Finish(Now(), strings.TrimSpace(body.By)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ws.writeCalibration(w)
+}
+
+// handleReadings takes a reading POSTed by a scale, in the same format it
+// would send over MQTT
+func (ws *WebServer) handleReadings(w http.ResponseWriter, r *http.Request) {
+	ws.lock.Lock()
+	token := ws.IngestToken
+	ws.lock.Unlock()
+	if token == "" {
+		http.Error(w, "Posting readings is turned off (set web.ingestToken)", http.StatusNotFound)
+		return
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+	if err != nil {
+		http.Error(w, "Failed to read the reading", http.StatusBadRequest)
+		return
+	}
+	if _, err := ws.Ingest.Accept("http "+r.RemoteAddr, payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// What was stored, i.e. after any calibration corrections
+	w.Header().Set("Content-Type", "application/json")
+	data := ws.Datastore.Get()
+	json.NewEncoder(w).Encode(struct {
+		Weight    float64   `json:"weight"`
+		TimeStamp time.Time `json:"timestamp"`
+		Remaining *float64  `json:"remaining"`
+		State     TankState `json:"state"`
+	}{data.Weight, data.TimeStamp, data.remaining(), data.State})
+}
+
+// handleHealth reports how each component is doing. It's a 503 if
+// anything that's turned on isn't running (or finished).
+func (ws *WebServer) handleHealth(w http.ResponseWriter, r *http.Request) {
+	ws.writeHealth(w, func(c ComponentStatus) bool { return c.State == ComponentRunning })
+}
+
+// handleReady is the same, except it's a 503 if anything that's turned on
+// isn't ready
+func (ws *WebServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	ws.writeHealth(w, func(c ComponentStatus) bool { return c.Ready })
+}
+
+func (ws *WebServer) writeHealth(w http.ResponseWriter, ok func(ComponentStatus) bool) {
+	var components []ComponentStatus
+	if ws.Health != nil {
+		components = ws.Health.Status()
+	}
+	status := "ok"
+	for _, c := range components {
+		if c.State != ComponentDisabled && c.State != ComponentFinished && !ok(c) {
+			status = "degraded"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Status     string            `json:"status"`
+		Components []ComponentStatus `json:"components"`
+	}{status, components})
+}
+
+func (ws *WebServer) handleOrdersCSV(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="orders.csv"`)
+
+	day := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return LocalTime(t).Format("2006-01-02")
+	}
+	date := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02")
+	}
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "state", "needed", "ordered_by", "supplier", "ordered", "expected", "delivered", "installed", "cancelled", "cost"})
+	for _, o := range ws.Orders.All() {
+		out.Write([]string{
+			strconv.Itoa(o.ID), string(o.State), day(o.NeededAt), o.OrderedByName, o.Supplier,
+			day(o.OrderedAt), date(o.ExpectedDelivery), day(o.DeliveredAt), day(o.InstalledAt), day(o.CancelledAt),
+			strconv.FormatFloat(o.Cost, 'f', 2, 64),
+		})
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Printf("Failed to write orders CSV: %v", err)
+	}
+}
+
 func (ws *WebServer) handleIndex(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path != "/" {
 		http.NotFound(w, r)
@@ -443,7 +1311,7 @@ func (ws *WebServer) handleIndex(w http.ResponseWriter, r *http.Request) {
                 padding: 1rem;
             }
             .data-display {
-                grid-template-columns: repeat(3, 1fr);
+                grid-template-columns: repeat(4, 1fr);
                 margin: 1rem 0;
             }
         }
@@ -472,6 +1340,11 @@ func (ws *WebServer) handleIndex(w http.ResponseWriter, r *http.Request) {
                     <div id="remaining" class="data-value">--</div>
                     <div class="data-unit">%</div>
                 </div>
+                <div class="data-item">
+                    <div class="data-label">Days Left</div>
+                    <div id="days" class="data-value">--</div>
+                    <div class="data-unit">at the current rate</div>
+                </div>
                 <div class="data-item">
                     <div class="data-label">Last Updated</div>
                     <div id="timestamp" class="data-value">--</div>
@@ -488,7 +1361,7 @@ func (ws *WebServer) handleIndex(w http.ResponseWriter, r *http.Request) {
             </div>
             
             <div class="refresh-info">
-                Data refreshes automatically every 5 seconds
+                Data updates automatically as new readings come in
             </div>
         </div>
     </div>
@@ -511,18 +1384,30 @@ func (ws *WebServer) handleIndex(w http.ResponseWriter, r *http.Request) {
             }
         }
         
+        const stateText = {
+            nocylinder: 'No cylinder on the scale',
+            overfull: 'Over full?',
+            belowtare: 'Below tare?'
+        };
+        
         function updateDisplay(data) {
             // Update individual data points
             document.getElementById('weight').textContent = Math.round(data.weight);
-            document.getElementById('remaining').textContent = Math.round(data.remaining);
+            document.getElementById('remaining').textContent = data.remaining === null ? '--' : Math.round(data.remaining);
+            document.getElementById('days').textContent = data.daysRemaining === null ? '--' : Math.round(data.daysRemaining);
             
-            // Format timestamp
-            const date = new Date(data.timestamp);
-            const timeStr = date.toLocaleString();
-            document.getElementById('timestamp').textContent = timeStr;
+            // The server formats the timestamp in the bot's timezone
+            document.getElementById('timestamp').textContent = data.time + ' (' + data.ago + ')';
             
             // Update progress bar
             const progressFill = document.getElementById('progress-fill');
+            if (data.state && data.state !== 'ok') {
+                // The weight doesn't make sense, so say why instead
+                progressFill.style.width = '100%';
+                progressFill.textContent = stateText[data.state] || data.state;
+                progressFill.style.background = 'repeating-linear-gradient(45deg, #9E9E9E, #9E9E9E 20px, #757575 20px, #757575 40px)';
+                return;
+            }
             const percentage = Math.round(data.remaining);
             progressFill.style.width = percentage + '%';
             progressFill.textContent = percentage + '%';
@@ -550,9 +1435,34 @@ func (ws *WebServer) handleIndex(w http.ResponseWriter, r *http.Request) {
             }
         }
         
-        // Start fetching data immediately and then every 5 seconds
-        fetchPropaneData();
-        updateInterval = setInterval(fetchPropaneData, 5000);
+        // Falls back to asking every 5 seconds
+        function startPolling() {
+            if (!updateInterval) {
+                fetchPropaneData();
+                updateInterval = setInterval(fetchPropaneData, 5000);
+            }
+        }
+        
+        // The server sends new data as soon as there is any. EventSource
+        // reconnects on its own if the connection drops, so we just say so
+        // in the meantime.
+        if (window.EventSource) {
+            const events = new EventSource('/api/propane/events');
+            events.onmessage = function(event) {
+                const data = JSON.parse(event.data);
+                updateDisplay(data);
+                updateStatus(data.message, false);
+            };
+            events.onerror = function() {
+                if (events.readyState === EventSource.CLOSED) {
+                    startPolling();
+                } else {
+                    updateStatus('Lost touch with the server, reconnecting...', true);
+                }
+            };
+        } else {
+            startPolling();
+        }
         
         // Clean up interval when page is unloaded
         window.addEventListener('beforeunload', function() {
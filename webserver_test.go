@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestWebServer(t *testing.T) (*WebServer, *Datastore, *CylinderStore) {
+	t.Helper()
+	dir := t.TempDir()
+	cyl := newTestCylinderStore(t)
+	ds := NewDatastore(cyl)
+	cyl.OnChange(ds.Refresh)
+	ws := &WebServer{
+		IngestToken: "sekrit",
+		Ingest:      &Ingester{Datastore: ds},
+		Datastore:   ds,
+		Cylinder:    cyl,
+		Calibration: NewCalibrationStore(filepath.Join(dir, calibrationFile)),
+		Orders:      NewOrderStore(filepath.Join(dir, ordersFile)),
+		History:     NewConsumptionHistory(filepath.Join(dir, historyFile), ds, cyl),
+	}
+	return ws, ds, cyl
+}
+
+func TestPropaneJSON(t *testing.T) {
+	ws, ds, _ := newTestWebServer(t)
+	ts := Now().Add(-5 * time.Minute).Truncate(time.Second)
+	ds.Set(110, ts)
+
+	w := httptest.NewRecorder()
+	ws.handlePropaneJSON(w, httptest.NewRequest("GET", "/api/propane", nil))
+
+	var got struct {
+		Weight        float64   `json:"weight"`
+		TimeStamp     time.Time `json:"timestamp"`
+		Ago           string    `json:"ago"`
+		Remaining     float64   `json:"remaining"`
+		State         TankState `json:"state"`
+		Message       string    `json:"message"`
+		DaysRemaining *float64  `json:"daysRemaining"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Weight != 110 || got.Remaining != 50 || got.State != TankOK || !got.TimeStamp.Equal(ts) {
+		t.Errorf("got %+v, want 110 lbs at 50%% from %s", got, ts)
+	}
+	if got.Ago != "5 minutes ago" {
+		t.Errorf("ago = %q, want 5 minutes ago", got.Ago)
+	}
+	if !strings.Contains(got.Message, "50% remaining") {
+		t.Errorf("message = %q, it should say how much is left", got.Message)
+	}
+	if got.DaysRemaining != nil {
+		t.Errorf("there's no history to make a forecast from, but got %v days remaining", *got.DaysRemaining)
+	}
+}
+
+func TestPropaneJSONStates(t *testing.T) {
+	tests := []struct {
+		name      string
+		weight    float64
+		state     TankState
+		remaining string
+	}{
+		{"half", 110, TankOK, "50"},
+		{"a bit over full", 162, TankOK, "100"},
+		{"over full", 170, TankOverFull, "100"},
+		{"a bit under empty", 58, TankOK, "0"},
+		{"below tare", 50, TankBelowTare, "0"},
+		{"nothing on the scale", 0.4, TankNoCylinder, "null"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws, ds, _ := newTestWebServer(t)
+			ds.Set(tt.weight, Now())
+
+			w := httptest.NewRecorder()
+			ws.handlePropaneJSON(w, httptest.NewRequest("GET", "/api/propane", nil))
+
+			var got struct {
+				State     TankState       `json:"state"`
+				Remaining json.RawMessage `json:"remaining"`
+				Message   string          `json:"message"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.State != tt.state || string(got.Remaining) != tt.remaining {
+				t.Errorf("state = %q, remaining = %s, want %q and %s", got.State, got.Remaining, tt.state, tt.remaining)
+			}
+			if tt.state != TankOK && strings.Contains(got.Message, "remaining") {
+				t.Errorf("message = %q, it shouldn't be giving a percentage", got.Message)
+			}
+		})
+	}
+}
+
+func TestPropaneEvents(t *testing.T) {
+	ws, ds, cyl := newTestWebServer(t)
+	ds.Set(110, Now())
+	server := httptest.NewServer(http.HandlerFunc(ws.handlePropaneEvents))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	type event struct {
+		Weight    float64 `json:"weight"`
+		Remaining float64 `json:"remaining"`
+	}
+	events := bufio.NewScanner(resp.Body)
+	next := func() event {
+		t.Helper()
+		for events.Scan() {
+			if payload, ok := strings.CutPrefix(events.Text(), "data: "); ok {
+				var got event
+				if err := json.Unmarshal([]byte(payload), &got); err != nil {
+					t.Fatal(err)
+				}
+				return got
+			}
+		}
+		t.Fatalf("the stream ended: %v", events.Err())
+		return event{}
+	}
+
+	// What's there now comes first
+	if got := next(); got.Weight != 110 || got.Remaining != 50 {
+		t.Errorf("first event = %+v, want 110 lbs at 50%%", got)
+	}
+	// Then new readings
+	ds.Set(135, Now())
+	if got := next(); got.Weight != 135 || got.Remaining != 75 {
+		t.Errorf("after a reading got %+v, want 135 lbs at 75%%", got)
+	}
+	// And the same weight with new cylinder settings is a new percentage
+	if err := cyl.Save(Cylinder{TareWeight: 35, FullWeight: 135}); err != nil {
+		t.Fatal(err)
+	}
+	if got := next(); got.Weight != 135 || got.Remaining != 100 {
+		t.Errorf("after changing the cylinder got %+v, want 135 lbs at 100%%", got)
+	}
+}
+
+func TestPostReadings(t *testing.T) {
+	ws, ds, _ := newTestWebServer(t)
+	ts := Now().Add(-time.Minute).Unix()
+
+	tests := []struct {
+		name   string
+		token  string
+		body   string
+		status int
+	}{
+		{"no token", "", fmt.Sprintf("%d,110", ts), http.StatusUnauthorized},
+		{"wrong token", "guess", fmt.Sprintf("%d,110", ts), http.StatusUnauthorized},
+		{"junk", "sekrit", "110 lbs", http.StatusBadRequest},
+		{"nonsense weight", "sekrit", fmt.Sprintf("%d,-110", ts), http.StatusBadRequest},
+		{"csv", "sekrit", fmt.Sprintf("%d,110", ts), http.StatusOK},
+		{"json", "sekrit", fmt.Sprintf(`{"timestamp": %d, "weight": 135}`, ts+1), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/readings", strings.NewReader(tt.body))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			ws.handleReadings(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d (%s)", w.Code, tt.status, strings.TrimSpace(w.Body.String()))
+			}
+		})
+	}
+
+	if got := ds.Get(); got.Weight != 135 || got.Remaining != 75 {
+		t.Errorf("the datastore has %+v, want the last good reading (135 lbs, 75%%)", got)
+	}
+}
+
+func TestPostReadingsTurnedOff(t *testing.T) {
+	ws, _, _ := newTestWebServer(t)
+	ws.SetIngestToken("")
+
+	r := httptest.NewRequest("POST", "/api/readings", strings.NewReader("1577640142,110"))
+	r.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	ws.handleReadings(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestCylinderSettings(t *testing.T) {
+	ws, _, cyl := newTestWebServer(t)
+
+	form := url.Values{"tareweight": {"17.5"}, "fullweight": {"37.5"}, "extraweight": {"1"}}
+	r := httptest.NewRequest("POST", "/cylinder", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ws.handleCylinderSettings(w, r)
+
+	want := Cylinder{TareWeight: 17.5, FullWeight: 37.5, ExtraWeight: 1}
+	if got := cyl.Get(); got != want {
+		t.Errorf("saved %+v, want %+v", got, want)
+	}
+	if !strings.Contains(w.Body.String(), "Whee!") {
+		t.Errorf("the page should say it saved")
+	}
+
+	form.Set("fullweight", "lots")
+	r = httptest.NewRequest("POST", "/cylinder", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	ws.handleCylinderSettings(w, r)
+
+	if got := cyl.Get(); got != want {
+		t.Errorf("a bad form changed the settings to %+v", got)
+	}
+	if !strings.Contains(w.Body.String(), "must be valid numbers") {
+		t.Errorf("the page should say what was wrong")
+	}
+
+	form.Set("fullweight", "10")
+	r = httptest.NewRequest("POST", "/cylinder", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	ws.handleCylinderSettings(w, r)
+
+	if got := cyl.Get(); got != want {
+		t.Errorf("settings that don't make sense were saved: %+v", got)
+	}
+	if !strings.Contains(w.Body.String(), "more than tareweight") {
+		t.Errorf("the page should say what was wrong")
+	}
+}
+
+func TestCalibrationAPI(t *testing.T) {
+	ws, ds, _ := newTestWebServer(t)
+	ws.Ingest.Calibration = ws.Calibration
+	now := Now()
+
+	call := func(method, path, body string, status int) calibrationResponse {
+		t.Helper()
+		var handler http.HandlerFunc
+		switch method + " " + path {
+		case "GET /api/calibration":
+			handler = ws.handleCalibrationJSON
+		case "POST /api/calibration":
+			handler = ws.handleCalibrationFinish
+		case "POST /api/calibration/points":
+			handler = ws.handleCalibrationPoint
+		case "DELETE /api/calibration/points":
+			handler = ws.handleCalibrationClear
+		}
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		if w.Code != status {
+			t.Fatalf("%s %s %s: status = %d, want %d (%s)", method, path, body, w.Code, status, strings.TrimSpace(w.Body.String()))
+		}
+		var got calibrationResponse
+		if status == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return got
+	}
+	// reading is the scale saying raw lbs
+	reading := func(raw float64, ago time.Duration) {
+		t.Helper()
+		if err := ws.Ingest.Store(Reading{raw, now.Add(-ago)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := call("GET", "/api/calibration", "", http.StatusOK); got.Current != nil || got.Raw != nil {
+		t.Fatalf("got %+v, want no calibration and no readings yet", got)
+	}
+	call("POST", "/api/calibration/points", `{"reference": 0}`, http.StatusBadRequest)
+
+	// An empty scale that says 1 lb, then a 50 lb weight it says is 53.5
+	reading(1, 5*time.Minute)
+	call("POST", "/api/calibration/points", `{"reference": 0}`, http.StatusOK)
+	call("POST", "/api/calibration/points", `{"reference": 50}`, http.StatusBadRequest)
+	reading(53.5, 4*time.Minute)
+	call("POST", "/api/calibration/points", `{}`, http.StatusBadRequest)
+	call("POST", "/api/calibration/points", `{"reference": -50}`, http.StatusBadRequest)
+	got := call("POST", "/api/calibration/points", `{"reference": 50}`, http.StatusOK)
+	if len(got.Pending) != 2 || got.Pending[1].Raw != 53.5 || got.Raw == nil || got.Raw.Weight != 53.5 {
+		t.Fatalf("got %+v, want both reference weights", got)
+	}
+
+	got = call("POST", "/api/calibration", `{"by": "Sam"}`, http.StatusOK)
+	if got.Current == nil || got.Current.By != "Sam" || len(got.History) != 1 || len(got.Pending) != 0 {
+		t.Fatalf("got %+v, want Sam's calibration saved", got)
+	}
+	if got.DueAt != nil {
+		t.Errorf("there's no reminder set, but it's due %s", got.DueAt)
+	}
+
+	// Readings from then on are corrected
+	reading(106, 3*time.Minute)
+	if w := ds.Get().Weight; math.Abs(w-100) > 0.01 {
+		t.Errorf("the scale saying 106 lbs should be corrected to 100, got %v", w)
+	}
+
+	// Starting over
+	reading(2, 2*time.Minute)
+	call("POST", "/api/calibration/points", `{"reference": 0}`, http.StatusOK)
+	if got := call("DELETE", "/api/calibration/points", "", http.StatusOK); len(got.Pending) != 0 {
+		t.Errorf("pending = %+v, want them cleared", got.Pending)
+	}
+	call("POST", "/api/calibration", "", http.StatusBadRequest)
+}
+
+func TestCalibrationPage(t *testing.T) {
+	ws, _, _ := newTestWebServer(t)
+	ws.Calibration.SetReminder(6)
+	post := func(form url.Values) string {
+		r := httptest.NewRequest("POST", "/calibration", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		ws.handleCalibration(w, r)
+		return w.Body.String()
+	}
+
+	w := httptest.NewRecorder()
+	ws.handleCalibration(w, httptest.NewRequest("GET", "/calibration", nil))
+	if !strings.Contains(w.Body.String(), "never been calibrated") {
+		t.Errorf("the page should say the scale hasn't been calibrated")
+	}
+
+	if err := ws.Ingest.Store(Reading{46, Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if page := post(url.Values{"action": {"add"}, "reference": {"lots"}}); !strings.Contains(page, "must be a number") {
+		t.Errorf("the page should say what was wrong")
+	}
+	if page := post(url.Values{"action": {"add"}, "reference": {"45"}}); !strings.Contains(page, "the scale said 46.00 lbs for 45 lbs") {
+		t.Errorf("the page should say the reference weight was added")
+	}
+	page := post(url.Values{"action": {"save"}, "name": {"<Sam>"}})
+	if !strings.Contains(page, "Whee!") || !strings.Contains(page, "&lt;Sam&gt;") {
+		t.Errorf("the page should say it saved, and who did it")
+	}
+	if c, ok := ws.Calibration.Current(); !ok || c.Offset != -1 {
+		t.Errorf("saved %+v, want an offset of -1", c)
+	}
+	w = httptest.NewRecorder()
+	ws.handleCalibration(w, httptest.NewRequest("GET", "/calibration", nil))
+	if !strings.Contains(w.Body.String(), "The next one is due") {
+		t.Errorf("the page should say when the next calibration is due")
+	}
+}
+
+// Running on just the environment, with no config file to watch, is still
+// healthy
+func TestHealthNoConfigFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sup, ctx := NewSupervisor(ctx)
+	path := filepath.Join(t.TempDir(), "config.json")
+	sup.Go("config", WatchConfig(ctx, path, DefaultConfig(), nil, func(old, new AppConfig) {}))
+	// Something that's done with its job on its own is fine too
+	sup.Go("oneshot", func() error { return nil })
+	waitFor(t, "oneshot to finish", func() bool {
+		for _, c := range sup.Status() {
+			if c.Name == "oneshot" {
+				return c.State == ComponentFinished
+			}
+		}
+		return false
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	ws := &WebServer{Health: sup}
+	w := httptest.NewRecorder()
+	ws.handleHealth(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200: %s", w.Code, w.Body.String())
+	}
+
+	// But something failing isn't
+	sup.Go("broken", func() error { return errors.New("nope") })
+	waitFor(t, "broken to fail", func() bool {
+		w = httptest.NewRecorder()
+		ws.handleHealth(w, httptest.NewRequest("GET", "/healthz", nil))
+		return w.Code == http.StatusServiceUnavailable
+	})
+}
+
+// setDisplay changes the display settings until the test is over
+func setDisplay(t *testing.T, cfg DisplayConfig) {
+	t.Helper()
+	displayMu.RLock()
+	location, format := displayLocation, displayFormat
+	displayMu.RUnlock()
+	t.Cleanup(func() {
+		displayMu.Lock()
+		defer displayMu.Unlock()
+		displayLocation, displayFormat = location, format
+	})
+	if err := SetDisplayConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The expected delivery date is whatever day it is where the people
+// ordering the gas are, not wherever the bot happens to run
+func TestOrdersExpectedDelivery(t *testing.T) {
+	setDisplay(t, DisplayConfig{Timezone: "Pacific/Auckland", TimeFormat: defaultTimeFormat})
+	auckland, err := time.LoadLocation("Pacific/Auckland")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, _, _ := newTestWebServer(t)
+
+	form := url.Values{"state": {"ordered"}, "name": {"Sam"}, "expected": {"2026-03-01"}}
+	r := httptest.NewRequest("POST", "/orders", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ws.handleOrders(w, r)
+
+	order, ok := NewOrderStore(ws.Orders.path).Current()
+	if !ok {
+		t.Fatalf("the order wasn't saved: %s", w.Body.String())
+	}
+	if want := time.Date(2026, 3, 1, 0, 0, 0, 0, auckland); !order.ExpectedDelivery.Equal(want) {
+		t.Errorf("expected delivery = %s, want %s", order.ExpectedDelivery, want)
+	}
+	if !strings.Contains(order.Describe(), "expected Sun Mar  1") {
+		t.Errorf("the order says %q, want it expected on Sun Mar 1", order.Describe())
+	}
+
+	form.Set("expected", "next week")
+	r = httptest.NewRequest("POST", "/orders", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	ws.handleOrders(w, r)
+	if !strings.Contains(w.Body.String(), "doesn&#39;t look like a date") {
+		t.Errorf("the page should say the date is wrong")
+	}
+}